@@ -0,0 +1,205 @@
+// Command qcfg works on qcfg config files.
+//
+// Usage:
+//
+//	qcfg fmt [-l] [-w] [file ...]
+//
+// fmt lays out each file canonically (see qcfg.Format), printing the result,
+// or the config on standard input when no file is given.
+// With -l the names of the files whose layout differs are printed instead, with -w the files are rewritten.
+//
+//	qcfg diff [-var name=value ...] old.cfg new.cfg
+//
+// diff prints the blocks, rows and columns added (+), removed (-) or changed (~) from old.cfg to new.cfg (see qcfg.Diff),
+// ignoring comments, layout, order and the %include file each element is in. ${VAR} is not substituted.
+// Configs using %if are only compared once its variables are given with -var (see qcfg.Loader.Vars),
+// so that a change within a section that is not read does not go unnoticed.
+// It exits with status 1 when there are differences, 2 on error.
+//
+//	qcfg merge [-o out.cfg] base.cfg ours.cfg theirs.cfg
+//
+// merge combines the changes made from base.cfg by ours.cfg and by theirs.cfg (see qcfg.Merge),
+// writing the result over ours.cfg, or to out.cfg, and the conflicts to standard error.
+// It exits with status 1 when there are conflicts, so that it can serve as a git merge driver:
+//
+//	[merge "qcfg"]
+//		driver = qcfg merge %O %A %B
+//
+// The files are read with qcfg.Loader.Raw: %include and the other directives are not followed but refused with status 2,
+// leaving ours.cfg as is for git to report a conflict, and ${...} is kept as written.
+// The result is ours.cfg with only the merged changes made to it (see qcfg.CfgBlock.Update), so that its comments and layout are kept.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/LDCS/qcfg"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: qcfg fmt [-l] [-w] [file ...]")
+	fmt.Fprintln(os.Stderr, "       qcfg diff [-var name=value ...] old.cfg new.cfg")
+	fmt.Fprintln(os.Stderr, "       qcfg merge [-o out.cfg] base.cfg ours.cfg theirs.cfg")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "fmt":
+		err = fmtCmd(os.Args[2:])
+	case "diff":
+		err = diffCmd(os.Args[2:])
+	case "merge":
+		err = mergeCmd(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "qcfg:", err)
+		os.Exit(2)
+	}
+}
+
+// fmtCmd runs "qcfg fmt"
+func fmtCmd(_args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	list := flags.Bool("l", false, "list files whose layout differs from qcfg fmt's")
+	write := flags.Bool("w", false, "write the result to the file instead of printing it")
+	flags.Parse(_args)
+
+	if flags.NArg() < 1 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		out, err := format("<stdin>", src)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	}
+	for _, fname := range flags.Args() {
+		src, err := os.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		out, err := format(fname, src)
+		if err != nil {
+			return err
+		}
+		switch {
+		case *list:
+			if !bytes.Equal(src, out) {
+				fmt.Println(fname)
+			}
+		case *write:
+			if !bytes.Equal(src, out) {
+				if err := qcfg.WriteFile(fname, out); err != nil {
+					return err
+				}
+			}
+		default:
+			os.Stdout.Write(out)
+		}
+	}
+	return nil
+}
+
+// format applies qcfg.Format to the content _src of the file _fname, naming the file in errors
+func format(_fname string, _src []byte) ([]byte, error) {
+	out, err := qcfg.Format(_src)
+	if perr, ok := err.(*qcfg.ParseError); ok {
+		perr.Fname = _fname
+	}
+	return out, err
+}
+
+// varFlags collects the -var name=value flags
+type varFlags map[string]string
+
+func (vars varFlags) String() string { return "" }
+
+func (vars varFlags) Set(_s string) error {
+	nn := strings.Index(_s, "=")
+	if nn < 1 {
+		return fmt.Errorf("%q is not name=value", _s)
+	}
+	vars[_s[:nn]] = _s[nn+1:]
+	return nil
+}
+
+// diffCmd runs "qcfg diff"
+func diffCmd(_args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	vars := varFlags{}
+	flags.Var(vars, "var", "set a variable tested by %if, as name=value")
+	flags.Parse(_args)
+	if flags.NArg() != 2 {
+		usage()
+	}
+	ld := qcfg.Loader{NoEnv: true, Vars: vars, NoConditions: len(vars) < 1}
+	a, err := ld.Load(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := ld.Load(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	changes := qcfg.Diff(a, b)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if len(changes) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// mergeCmd runs "qcfg merge"
+func mergeCmd(_args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := flags.String("o", "", "write the result to this file instead of over ours")
+	flags.Parse(_args)
+	if flags.NArg() != 3 {
+		usage()
+	}
+	ld := qcfg.Loader{Raw: true}
+	var cfgs [3]*qcfg.CfgBlock
+	for ii, fname := range flags.Args() {
+		cfg, err := ld.Load(fname)
+		if err != nil {
+			return err
+		}
+		cfgs[ii] = cfg
+	}
+	merged, conflicts := qcfg.Merge(cfgs[0], cfgs[1], cfgs[2])
+	cfgs[1].Update(merged)
+	var buf bytes.Buffer
+	if err := cfgs[1].WriteSource(&buf); err != nil {
+		return err
+	}
+	if *out == "" {
+		*out = flags.Arg(1)
+	}
+	if err := qcfg.WriteFile(*out, buf.Bytes()); err != nil {
+		return err
+	}
+	for _, conflict := range conflicts {
+		fmt.Fprintln(os.Stderr, conflict)
+	}
+	if len(conflicts) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LDCS/qcfg"
+)
+
+// writeFiles writes each name and content pair of _files into _dir, returning the paths
+func writeFiles(t *testing.T, _dir string, _files ...string) []string {
+	var fnames []string
+	for ii := 0; ii < len(_files); ii += 2 {
+		fname := filepath.Join(_dir, _files[ii])
+		if err := os.WriteFile(fname, []byte(_files[ii+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fnames = append(fnames, fname)
+	}
+	return fnames
+}
+
+// To test that mergeCmd() keeps ${...} as written and refuses %include
+func TestMergeCmd(t *testing.T) {
+	dir := t.TempDir()
+	fnames := writeFiles(t, dir,
+		"base.cfg", "%block db\n{\n  main :: host=${DB_HOST}; port=1; url=${db.main.host}:${db.main.port};\n  old  :: x=1;\n}\n",
+		"ours.cfg", "# ours\n%block db\n{\n  main :: host=${DB_HOST}; port=2; url=${db.main.host}:${db.main.port};   # main\n  old  :: x=1;\n}\n",
+		"theirs.cfg", "%block db\n{\n  main :: host=${DB_HOST}; port=1; url=${db.main.host}:${db.main.port}; user=\"a b\";\n}\n",
+	)
+	if err := mergeCmd(fnames); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := os.ReadFile(fnames[1])
+	want := "# ours\n%block db\n{\n  main :: host=${DB_HOST}; port=2; url=${db.main.host}:${db.main.port};   # main\n" +
+		"       += user=a b;\n}\n"
+	if string(out) != want {
+		t.Errorf("Expected only the changes of theirs made to ours, ${DB_HOST} written unquoted, got\n%s", out)
+	}
+	ld := qcfg.Loader{FS: os.DirFS(dir), LookupEnv: func(_name string) (string, bool) { return "h1", _name == "DB_HOST" }}
+	cfg, err := ld.Load("ours.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("db", "main", "url", "") != "h1:2" || cfg.Str("db", "main", "user", "") != "a b" {
+		t.Errorf("Expected the merged file to read back with ${...} substituted, got %q", cfg.Str("db", "main", "url", ""))
+	}
+
+	fnames = writeFiles(t, dir,
+		"base.cfg", "%include common.cfg\nr :: a=1;\n",
+		"ours.cfg", "%include common.cfg\nr :: a=2;\n",
+		"theirs.cfg", "%include common.cfg\nr :: a=1;\n",
+		"common.cfg", "%block common\n{\n  c :: x=1;\n}\n",
+	)
+	if err := mergeCmd(fnames[:3]); !errors.Is(err, qcfg.ErrNotAllowed) {
+		t.Errorf("Expected ErrNotAllowed for %%include, got %v", err)
+	}
+	if out, _ := os.ReadFile(fnames[1]); string(out) != "%include common.cfg\nr :: a=2;\n" {
+		t.Errorf("Expected ours to be left as is, got\n%s", out)
+	}
+}
+
+// To test that diffCmd() and mergeCmd() do not skip %if sections unseen
+func TestConditionsCmd(t *testing.T) {
+	dir := t.TempDir()
+	fnames := writeFiles(t, dir,
+		"base.cfg", "%if env == prod\nr :: host=p1;\n%else\nr :: host=d1;\n%endif\n",
+		"ours.cfg", "%if env == prod\nr :: host=p2;\n%else\nr :: host=d1;\n%endif\n",
+		"theirs.cfg", "%if env == prod\nr :: host=p1;\n%else\nr :: host=d1;\n%endif\n",
+	)
+	if err := diffCmd(fnames[:2]); !errors.Is(err, qcfg.ErrNotAllowed) {
+		t.Errorf("Expected ErrNotAllowed for %%if without -var, got %v", err)
+	}
+	if err := diffCmd(append([]string{"-var", "env=dev"}, fnames[:2]...)); err != nil {
+		t.Errorf("Expected no error with -var, got %v", err)
+	}
+	if err := mergeCmd(fnames); !errors.Is(err, qcfg.ErrNotAllowed) {
+		t.Errorf("Expected ErrNotAllowed for %%if, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package qcfg
+
+import (
+	"bytes"
+	"os"
+	"strings"
+)
+
+// condFrame is a section opened by %if, within the file being read
+type condFrame struct {
+	taken  bool // whether the lines of the current branch are read
+	inElse bool
+	line   int    // where the %if is, for reporting
+	text   string // the %if line
+}
+
+// skipping reports whether the lines being read from src are within a branch of %if that is not taken
+func (src *cfgSource) skipping() bool {
+	for _, cond := range src.conds {
+		if !cond.taken {
+			return true
+		}
+	}
+	return false
+}
+
+// skipRow reads past the lines of any heredoc value of the row line last read from src, within a branch that is not taken.
+// Those lines are appended to the row line, as loadRow does
+func skipRow(src *cfgSource) {
+	line := src.cur()
+	start := rowStart(line.text)
+	if start < 0 || !bytes.Contains(line.text, []byte("<<")) {
+		return
+	}
+	_, line.text, _ = scanCols(line.text, start, src.readRaw)
+}
+
+// condition applies the %if, %else or %endif line _line to src.
+// The condition of an %if within a branch that is not taken is not evaluated
+func (p *parser) condition(src *cfgSource, _line []byte) error {
+	switch {
+	case lineIsDirective(_line, "%if"):
+		cond := &condFrame{line: src.line, text: string(_line)}
+		var err error
+		if !src.skipping() {
+			cond.taken, err = p.evalCond(src, bytes.TrimSpace(_line[len("%if"):]))
+		}
+		src.conds = append(src.conds, cond)
+		return err
+	case len(src.conds) < 1:
+		return ErrUnmatchedCond
+	case lineIsDirective(_line, "%else"):
+		cond := src.conds[len(src.conds)-1]
+		if cond.inElse {
+			return ErrUnmatchedCond
+		}
+		cond.taken, cond.inElse = !cond.taken, true
+		_line = _line[len("%else"):]
+	default:
+		src.conds = src.conds[:len(src.conds)-1]
+		_line = _line[len("%endif"):]
+	}
+	if len(bytes.TrimSpace(_line)) > 0 {
+		return ErrBadDirective
+	}
+	return nil
+}
+
+// evalCond returns the value of the condition _expr of an %if: "NAME" when the variable NAME is set and not empty,
+// "!NAME" when it is not, "NAME == value" or "NAME != value", the value being a word or double-quoted, then holding blanks or # as well.
+// Variables are those of ${NAME}, then "hostname" gives the name of the host when not set otherwise
+func (p *parser) evalCond(src *cfgSource, _expr []byte) (bool, error) {
+	expr := string(_expr)
+	lookup := func(_name string) (string, bool) {
+		val, ok := p.ld.lookupVar(_name, src.vars)
+		if !ok && _name == "hostname" {
+			if host, err := os.Hostname(); err == nil {
+				return host, true
+			}
+		}
+		return val, ok
+	}
+	negate := strings.HasPrefix(expr, "!") && !strings.HasPrefix(expr, "!=")
+	if negate {
+		expr = strings.TrimLeft(expr[1:], " \t")
+	}
+	nn := strings.IndexAny(expr, " \t=!") // the operator follows the name, the value may hold one as well
+	if nn < 0 {
+		nn = len(expr)
+	}
+	name, rest := expr[:nn], strings.TrimLeft(expr[nn:], " \t")
+	if !isVarName(name) {
+		return false, ErrBadDirective
+	}
+	if rest != "" {
+		if negate || !(strings.HasPrefix(rest, "==") || strings.HasPrefix(rest, "!=")) {
+			return false, ErrBadDirective
+		}
+		want := strings.TrimSpace(rest[2:])
+		if len(want) > 1 && want[0] == '"' && want[len(want)-1] == '"' {
+			want = want[1 : len(want)-1]
+		} else if want == "" || strings.ContainsAny(want, " \t\"") {
+			return false, ErrBadDirective
+		}
+		val, _ := lookup(name)
+		return (val == want) == (rest[0] == '='), nil
+	}
+	val, _ := lookup(name)
+	return (val != "") != negate, nil
+}
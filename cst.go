@@ -0,0 +1,569 @@
+package qcfg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNoSource is returned when writing back the source of a config that was not read from a file, e.g. one made by NewCfgMem
+var ErrNoSource = errors.New("config was not read from a file")
+
+// ErrRemoved is returned when writing back the source of a config edited by EditEntry where %unset or %delete removed the element:
+// the directive would remove it again when the source is read
+var ErrRemoved = errors.New("edit of an element removed by %unset or %delete")
+
+// ErrNotInSource is returned when writing back the source of a config where Update changed an element not written as such in the source,
+// e.g. a row inherited through %extends: the source would still give it when read
+var ErrNotInSource = errors.New("update of an element not written in the source")
+
+// cstDoc is the concrete syntax of a loaded config: every line of every file read, kept as read,
+// so that a file can be written back with only the edited values changed
+type cstDoc struct {
+	root  *cstFile
+	files []*cstFile // in the order read, a file included more than once appearing each time
+	err   error      // the first edit that cannot be written back, see ErrRemoved
+	raw   bool       // read by Loader.Raw, values being written as for WriteOptions.Raw
+}
+
+// cstFile holds the lines of one file, whose concatenation is the file content
+type cstFile struct {
+	fname string
+	path  string // the OS file it was read from, to be saved to, "" when read through a Loader.FS or by LoadReader
+	lines []*cstLine
+	dirty bool // edited since it was read or saved
+}
+
+// cstLine is one line with its line terminator, or several when a heredoc value carries a row over the following lines
+type cstLine struct {
+	text  []byte
+	cells []*cstCell // the values within text, moved along when one of them is edited
+}
+
+// cstCell locates the source text of a column value, quotes and heredoc included, within a line
+type cstCell struct {
+	file     *cstFile
+	line     *cstLine
+	from, to int
+}
+
+// cstBlock locates a block within the concrete syntax
+type cstBlock struct {
+	doc     *cstDoc
+	file    *cstFile        // the file holding the "%block" line, or the top-level file
+	close   *cstLine        // the closing "}", nil for the top-level block, whose rows end at EOF
+	lines   []*cstLine      // the "%block" line and the closing "}" of each declaration, in pairs
+	removed map[string]bool // the rows and nested blocks removed by %delete, by kind and name
+}
+
+// cstRow locates a row within the concrete syntax
+type cstRow struct {
+	file    *cstFile // the file holding last
+	first   *cstLine // the "::" line
+	last    *cstLine // the last "+=" line continuing the row, or first
+	cells   map[string]*cstCell
+	removed map[string]bool // the columns removed by %unset
+}
+
+// addCell records that the source text of a value of the file _file lies at [_from, _to) within line
+func (line *cstLine) addCell(_file *cstFile, _from, _to int) *cstCell {
+	cell := &cstCell{_file, line, _from, _to}
+	line.cells = append(line.cells, cell)
+	return cell
+}
+
+// setCell records where the value of column _col was read from
+func (row *cstRow) setCell(_col string, _cell *cstCell) {
+	if row.cells == nil {
+		row.cells = make(map[string]*cstCell, 1)
+	}
+	row.cells[_col] = _cell
+	delete(row.removed, _col)
+}
+
+// remove records that %unset removed the column _col
+func (row *cstRow) remove(_col string) {
+	delete(row.cells, _col)
+	if row.removed == nil {
+		row.removed = make(map[string]bool, 1)
+	}
+	row.removed[_col] = true
+}
+
+// remove records that %delete removed the row or nested block of kind _kind named _name
+func (blk *cstBlock) remove(_kind, _name string) {
+	if blk.removed == nil {
+		blk.removed = make(map[string]bool, 1)
+	}
+	blk.removed[_kind+" "+_name] = true
+}
+
+// set replaces the source text of the value with _text, moving along the cells that follow it on the line
+func (cell *cstCell) set(_text string) {
+	from := cell.from
+	cell.line.splice(cell.from, cell.to, _text)
+	cell.from, cell.to = from, from+len(_text) // an empty value was moved along as well
+	cell.file.dirty = true
+}
+
+// splice replaces the text of line within [_from, _to) with _text, moving along the cells that follow it
+func (line *cstLine) splice(_from, _to int, _text string) {
+	line.text = append(append(append([]byte{}, line.text[:_from]...), _text...), line.text[_to:]...)
+	delta := len(_text) - (_to - _from)
+	for _, cc := range line.cells {
+		if cc.from >= _to {
+			cc.from += delta
+			cc.to += delta
+		}
+	}
+}
+
+// fail records that the element at _path cannot be written back, unless an earlier edit could not be either
+func (doc *cstDoc) fail(_path string, _err error) {
+	if doc.err == nil {
+		doc.err = fmt.Errorf("%s: %w", _path, _err)
+	}
+}
+
+// removeLines removes the lines _from to _to from the file holding them, reporting false when they are not found in that order
+func (doc *cstDoc) removeLines(_from, _to *cstLine) bool {
+	for _, file := range doc.files {
+		ii := file.index(_from)
+		if ii < 0 {
+			continue
+		}
+		for jj := ii; jj < len(file.lines); jj++ {
+			if file.lines[jj] == _to {
+				file.lines = append(file.lines[:ii], file.lines[jj+1:]...)
+				file.dirty = true
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// removeBlock removes from the source the lines of each declaration of blk, from its "%block" line to its closing "}"
+func (doc *cstDoc) removeBlock(blk *cstBlock) bool {
+	if len(blk.lines) < 2 || len(blk.lines)%2 != 0 {
+		return false
+	}
+	for ii := 0; ii < len(blk.lines); ii += 2 {
+		if !doc.removeLines(blk.lines[ii], blk.lines[ii+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeRow removes from the source the "::" line of row, the lines of its values and the "+=" lines continuing it.
+// The comments, blank lines and directives among them are kept
+func (doc *cstDoc) removeRow(row *cstRow) bool {
+	if row.first == nil || row.file == nil {
+		return false
+	}
+	own := map[*cstLine]bool{row.first: true, row.last: true}
+	for _, cell := range row.cells {
+		own[cell.line] = true
+	}
+	from, to := row.file.index(row.first), row.file.index(row.last)
+	if from < 0 || to < from {
+		return false
+	}
+	var lines []*cstLine
+	inRow := false // whether a "+=" line continues row, as prevRow in loadBlock
+	for _, line := range row.file.lines[from : to+1] {
+		trimmed := bytes.TrimLeft(line.text, " \t")
+		switch {
+		case own[line]:
+			inRow = true
+		case bytes.HasPrefix(trimmed, []byte("+=")):
+		case len(trimmed) > 0 && trimmed[0] != '%' && trimmed[0] != '#' && rowStart(line.text) >= 0:
+			inRow = false // another row, e.g. between the declarations of one repeated under DupMerge
+			continue
+		default:
+			continue
+		}
+		if inRow {
+			lines = append(lines, line)
+		}
+	}
+	for line := range own {
+		if row.file.index(line) < 0 {
+			lines = append(lines, line) // a value read from another file
+		}
+	}
+	for _, line := range lines {
+		doc.removeLines(line, line)
+	}
+	return true
+}
+
+// removeCell removes from the source the column _col of row, its name and separator included,
+// and the "+=" line it was on when no other column is left there. It reports false when the column was not read from the source
+func (doc *cstDoc) removeCell(row *cstRow, _col string) bool {
+	cell := row.cells[_col]
+	if cell == nil {
+		return false
+	}
+	line := cell.line
+	from, to, prev := rowStart(line.text), cell.to, -1
+	for _, cc := range line.cells {
+		if cc != cell && cc.to <= cell.from && cc.to > prev {
+			prev = cc.to
+		}
+	}
+	if prev >= 0 {
+		from = prev // "a=1; b=2" loses "; b=2"
+	} else {
+		// "a=1; b=2" loses "a=1; "
+		for ; from < cell.from && bytes.IndexByte([]byte(" \t;"), line.text[from]) >= 0; from++ {
+		}
+		for ; to < len(line.text) && bytes.IndexByte([]byte(" \t;"), line.text[to]) >= 0; to++ {
+		}
+		if to == len(line.text) || line.text[to] == '\n' || line.text[to] == '\r' {
+			for ; from > 0 && (line.text[from-1] == ' ' || line.text[from-1] == '\t'); from-- {
+			}
+		}
+	}
+	for ii, cc := range line.cells {
+		if cc == cell {
+			line.cells = append(line.cells[:ii], line.cells[ii+1:]...)
+			break
+		}
+	}
+	line.splice(from, to, "")
+	cell.file.dirty = true
+	delete(row.cells, _col)
+	if len(line.cells) > 0 || line == row.first {
+		return true
+	}
+	doc.removeLines(line, line)
+	if line == row.last {
+		row.last = row.first
+		for _, cc := range row.cells {
+			if cc.file == row.file && row.file.index(cc.line) > row.file.index(row.last) {
+				row.last = cc.line
+			}
+		}
+	}
+	return true
+}
+
+// eol returns the line terminator used by file
+func (file *cstFile) eol() string {
+	for _, line := range file.lines {
+		if bytes.HasSuffix(line.text, []byte("\r\n")) {
+			return "\r\n"
+		} else if bytes.HasSuffix(line.text, []byte("\n")) {
+			return "\n"
+		}
+	}
+	return "\n"
+}
+
+// index returns the position of _line within file, -1 when it is not there
+func (file *cstFile) index(_line *cstLine) int {
+	for ii, line := range file.lines {
+		if line == _line {
+			return ii
+		}
+	}
+	return -1
+}
+
+// insert adds _line to file, just before _at or after it when _after, at the end of the file when _at is nil
+func (file *cstFile) insert(_at *cstLine, _after bool, _line *cstLine) {
+	nn := len(file.lines)
+	for ii, line := range file.lines {
+		if line == _at {
+			nn = ii
+			if _after {
+				nn++
+			}
+			break
+		}
+	}
+	if nn > 0 && !bytes.HasSuffix(file.lines[nn-1].text, []byte("\n")) {
+		file.lines[nn-1].text = append(file.lines[nn-1].text, file.eol()...)
+	}
+	file.lines = append(file.lines, nil)
+	copy(file.lines[nn+1:], file.lines[nn:])
+	file.lines[nn] = _line
+	file.dirty = true
+}
+
+// newRowLine returns a line of file made of _prefix followed by the columns _cols of row, with the cells of their values
+func (file *cstFile) newRowLine(_prefix string, row *cfgRow, _cols []string, _raw bool) (*cstLine, []*cstCell) {
+	line := &cstLine{text: []byte(_prefix)}
+	var cells []*cstCell
+	for ii, col := range _cols {
+		if ii > 0 {
+			line.text = append(line.text, ' ')
+		}
+		val := quoteValue(row.cols[col], _raw)
+		line.text = append(line.text, col+"="...)
+		from := len(line.text)
+		line.text = append(append(line.text, val...), ';')
+		cells = append(cells, line.addCell(file, from, from+len(val)))
+	}
+	if len(_cols) < 1 {
+		line.text = bytes.TrimRight(line.text, " \t")
+	}
+	line.text = append(line.text, file.eol()...)
+	return line, cells
+}
+
+// indentOf returns the blanks that start _line
+func indentOf(_line *cstLine) string {
+	return string(_line.text[:len(_line.text)-len(bytes.TrimLeft(_line.text, " \t"))])
+}
+
+// rowIndent returns the indentation of the rows of blk, taken from a row of blk read from its file
+func (blk *CfgBlock) rowIndent() string {
+	for _, name := range blk.rowOrder {
+		if syn := blk.rows[name].syn; syn != nil && syn.first != nil && syn.file == blk.syn.file {
+			return indentOf(syn.first)
+		}
+	}
+	if blk.syn.close == nil {
+		return ""
+	}
+	return indentOf(blk.syn.close) + "\t"
+}
+
+// editSource records in the concrete syntax that EditEntry set column _col of row, within tbl, a block of cfg, to _val.
+// The value is replaced where it was read from, a new column is added on a "+=" line after the row,
+// a new row at the end of its block and a new block at the end of cfg
+func (cfg *CfgBlock) editSource(tbl *CfgBlock, row *cfgRow, _col, _val string) {
+	if cfg.syn == nil {
+		return
+	}
+	switch {
+	case row.syn != nil && row.syn.removed[_col],
+		row.syn == nil && tbl.syn != nil && tbl.syn.removed[KindRow+" "+row.name],
+		tbl.syn == nil && cfg.syn.removed[KindBlock+" "+tbl.name]:
+		cfg.syn.doc.fail(tbl.name+"."+row.name+"."+_col, ErrRemoved)
+		return
+	}
+	if tbl.syn == nil {
+		cfg.addBlockSource(tbl)
+	}
+	tbl.setSource(row, _col)
+}
+
+// addBlockSource adds an empty "%block" for tbl, a nested block of cfg, at the end of cfg in its source
+func (cfg *CfgBlock) addBlockSource(tbl *CfgBlock) {
+	indent := cfg.rowIndent()
+	eol := cfg.syn.file.eol()
+	open := &cstLine{text: []byte(indent + "%block " + tbl.name + eol)}
+	tbl.syn = &cstBlock{doc: cfg.syn.doc, file: cfg.syn.file, close: &cstLine{text: []byte(indent + "}" + eol)}}
+	tbl.syn.lines = []*cstLine{open, tbl.syn.close}
+	for _, line := range []*cstLine{{text: []byte(eol)}, open, {text: []byte(indent + "{" + eol)}, tbl.syn.close} {
+		cfg.syn.file.insert(cfg.syn.close, false, line)
+	}
+}
+
+// setSource records in the source of cfg that column _col of its row row was set.
+// The value is replaced where it was read from, a new column is added on a "+=" line after the row
+// and a new row, with only that column, at the end of cfg
+func (cfg *CfgBlock) setSource(row *cfgRow, _col string) {
+	if row.syn != nil {
+		if cell := row.syn.cells[_col]; cell != nil {
+			cell.set(quoteValue(row.cols[_col], cfg.syn.doc.raw))
+			return
+		}
+	}
+	if row.syn == nil || row.syn.last == nil {
+		cfg.addRowSource(row, []string{_col})
+		return
+	}
+	indent := indentOf(row.syn.last)
+	if row.syn.last == row.syn.first {
+		// line up "+=" under the "::" of the row
+		if nn := bytes.Index(row.syn.first.text, []byte("::")); nn >= 0 {
+			indent = strings.Map(func(r rune) rune {
+				if r == '\t' {
+					return r
+				}
+				return ' '
+			}, string(row.syn.first.text[:nn]))
+		}
+	}
+	line, cells := row.syn.file.newRowLine(indent+"+= ", row, []string{_col}, cfg.syn.doc.raw)
+	row.syn.file.insert(row.syn.last, true, line)
+	row.syn.last = line
+	row.syn.setCell(_col, cells[0])
+}
+
+// addRowSource adds a "::" line for the columns _cols of row at the end of cfg in its source
+func (cfg *CfgBlock) addRowSource(row *cfgRow, _cols []string) {
+	line, cells := cfg.syn.file.newRowLine(cfg.rowIndent()+row.name+" :: ", row, _cols, cfg.syn.doc.raw)
+	cfg.syn.file.insert(cfg.syn.close, false, line)
+	row.syn = &cstRow{file: cfg.syn.file, first: line, last: line}
+	for ii, col := range _cols {
+		row.syn.setCell(col, cells[ii])
+	}
+}
+
+// Update makes cfg hold the content of _to, e.g. the result of Merge, changing for a loaded config only what differs in its source, see WriteSource.
+// Values are replaced where they were read from, new columns, rows and blocks are added as by EditEntry,
+// and those that _to lacks are removed along with their lines, comments being kept.
+// Nothing is written back, giving ErrRemoved or ErrNotInSource, once an element removed by %unset or %delete
+// or one not written as such in the source, e.g. inherited through %extends, is changed
+func (cfg *CfgBlock) Update(_to *CfgBlock) {
+	var doc *cstDoc
+	if cfg.syn != nil {
+		doc = cfg.syn.doc
+	}
+	cfg.update(_to, "", doc)
+}
+
+// update makes cfg, whose dotted path is _path, hold the content of _to, changing the source of _doc when there is one
+func (cfg *CfgBlock) update(_to *CfgBlock, _path string, _doc *cstDoc) {
+	// source returns whether the change of the element _name can be made to the source of cfg, recording why not otherwise
+	source := func(_name string, _removed bool) bool {
+		switch {
+		case _doc == nil:
+			return false
+		case cfg.syn == nil:
+			_doc.fail(_path+_name, ErrNotInSource)
+			return false
+		case _removed:
+			_doc.fail(_path+_name, ErrRemoved)
+			return false
+		}
+		return true
+	}
+	for _, name := range append([]string{}, cfg.rowOrder...) {
+		if _, ok := _to.rows[name]; ok {
+			continue
+		}
+		if row := cfg.rows[name]; source(name, false) && (row.syn == nil || !_doc.removeRow(row.syn)) {
+			_doc.fail(_path+name, ErrNotInSource)
+		}
+		delete(cfg.rows, name)
+		cfg.rowOrder = removeName(cfg.rowOrder, name)
+	}
+	for _, name := range _to.rowOrder {
+		torow := _to.rows[name]
+		row, ok := cfg.rows[name]
+		if !ok {
+			row = newCfgRow(name)
+			for _, col := range torow.colOrder {
+				row.setCol(col, torow.cols[col])
+			}
+			cfg.setRow(row)
+			if source(name, cfg.syn != nil && cfg.syn.removed[KindRow+" "+name]) {
+				cfg.addRowSource(row, row.colOrder)
+			}
+			continue
+		}
+		for _, col := range append([]string{}, row.colOrder...) {
+			if _, ok := torow.cols[col]; ok {
+				continue
+			}
+			if source(name+"."+col, false) && (row.syn == nil || !_doc.removeCell(row.syn, col)) {
+				_doc.fail(_path+name+"."+col, ErrNotInSource)
+			}
+			delete(row.cols, col)
+			row.colOrder = removeName(row.colOrder, col)
+		}
+		for _, col := range torow.colOrder {
+			if val, ok := row.cols[col]; ok && val == torow.cols[col] {
+				continue
+			}
+			row.setCol(col, torow.cols[col])
+			if source(name+"."+col, row.syn != nil && row.syn.removed[col]) {
+				cfg.setSource(row, col)
+			}
+		}
+	}
+	for _, name := range append([]string{}, cfg.tblOrder...) {
+		if _, ok := _to.tbls[name]; ok {
+			continue
+		}
+		if tbl := cfg.tbls[name]; source(name, false) && (tbl.syn == nil || !_doc.removeBlock(tbl.syn)) {
+			_doc.fail(_path+name, ErrNotInSource)
+		}
+		delete(cfg.tbls, name)
+		cfg.tblOrder = removeName(cfg.tblOrder, name)
+	}
+	for _, name := range _to.tblOrder {
+		tbl, ok := cfg.tbls[name]
+		if !ok {
+			tbl = newCfgBlock(name, cfg.fname)
+			cfg.setBlock(name, tbl)
+			if source(name, cfg.syn != nil && cfg.syn.removed[KindBlock+" "+name]) {
+				cfg.addBlockSource(tbl)
+			}
+		}
+		tbl.update(_to.tbls[name], _path+name+".", _doc)
+	}
+}
+
+// writeTo writes the lines of file to w
+func (file *cstFile) writeTo(w io.Writer) error {
+	for _, line := range file.lines {
+		if _, err := w.Write(line.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSource writes the top-level file of cfg as it was read, with the changes made by EditEntry since applied in place.
+// Comments, blank lines, %include directives and the layout of rows are kept byte for byte,
+// only the edited values are rewritten, new rows and blocks being added at the end of their enclosing block.
+// Edits to files included by the top-level file are not written, see SaveAll.
+// Nothing is written, giving ErrRemoved, once an element removed by %unset or %delete has been edited
+func (cfg *CfgBlock) WriteSource(w io.Writer) error {
+	if cfg.syn == nil {
+		return ErrNoSource
+	}
+	if cfg.syn.doc.err != nil {
+		return cfg.syn.doc.err
+	}
+	return cfg.syn.doc.root.writeTo(w)
+}
+
+// SaveAll writes back every file of cfg changed by EditEntry, see WriteSource.
+// Each change is saved into the file its row or block was read from, the top-level file or one it includes,
+// so that the %include structure is kept. Files read through a Loader.FS or by LoadReader cannot be saved, giving ErrNoSource.
+// Each file is replaced atomically, see WriteOptions
+func (cfg *CfgBlock) SaveAll(_opts ...WriteOptions) error {
+	if cfg.syn == nil {
+		return ErrNoSource
+	}
+	if cfg.syn.doc.err != nil {
+		return cfg.syn.doc.err
+	}
+	saved := make(map[string]bool)
+	for _, file := range cfg.syn.doc.files {
+		if !file.dirty {
+			continue
+		}
+		if file.path == "" {
+			return fmt.Errorf("%s: %w", file.fname, ErrNoSource)
+		}
+		if saved[file.path] {
+			return fmt.Errorf("%s: edited where it is included more than once", file.fname)
+		}
+		saved[file.path] = true
+	}
+	for _, file := range cfg.syn.doc.files {
+		if !file.dirty {
+			continue
+		}
+		var buf bytes.Buffer
+		file.writeTo(&buf)
+		if err := writeFile(file.path, buf.Bytes(), _opts); err != nil {
+			return err
+		}
+		file.dirty = false
+	}
+	return nil
+}
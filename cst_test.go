@@ -0,0 +1,239 @@
+package qcfg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// To test WriteSource() after EditEntry()
+func TestWriteSource(t *testing.T) {
+	main := `# top comment
+%include inc.cfg
+
+%block app   # the app
+{
+    server      :: host=alpha;  port=80;   # keep me
+                += user=bob;
+    query :: sql=<<EOT
+select 1
+EOT; db=main;
+}
+`
+	fsys := fstest.MapFS{
+		"main.cfg": {Data: []byte(main)},
+		"inc.cfg":  {Data: []byte("%block shared\n{\n  limits :: max=10;\n}\n")},
+	}
+	cfg, err := LoadFS(fsys, "main.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := cfg.WriteSource(&out); err != nil || out.String() != main {
+		t.Fatalf("Expected the unedited source back, got %v\n%s", err, out.String())
+	}
+
+	cfg.EditEntry("app", "server", "port", "8080")
+	cfg.EditEntry("app", "server", "host", "a;b")
+	cfg.EditEntry("app", "query", "sql", "select 2\nfrom dual")
+	cfg.EditEntry("app", "query", "db", "x")
+	cfg.EditEntry("app", "server", "tz", "UTC")
+	cfg.EditEntry("app", "client", "id", "7")
+	cfg.EditEntry("shared", "limits", "max", "20")
+	cfg.EditEntry("extra", "row", "col", "v")
+	want := `# top comment
+%include inc.cfg
+
+%block app   # the app
+{
+    server      :: host="a;b";  port=8080;   # keep me
+                += user=bob;
+                += tz=UTC;
+    query :: sql=<<EOT
+select 2
+from dual
+EOT; db=x;
+    client :: id=7;
+}
+
+%block extra
+{
+	row :: col=v;
+}
+`
+	out.Reset()
+	if err := cfg.WriteSource(&out); err != nil || out.String() != want {
+		t.Fatalf("WriteSource gave %v\n%s\nwant\n%s", err, out.String(), want)
+	}
+
+	fsys["main.cfg"] = &fstest.MapFile{Data: []byte(out.String())}
+	cfg2, err := LoadFS(fsys, "main.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ tbl, row, col, want string }{
+		{"app", "server", "host", "a;b"}, {"app", "server", "tz", "UTC"}, {"app", "query", "sql", "select 2\nfrom dual"},
+		{"app", "query", "db", "x"}, {"app", "client", "id", "7"}, {"extra", "row", "col", "v"}, {"shared", "limits", "max", "10"},
+	} {
+		if got := cfg2.Str(tt.tbl, tt.row, tt.col, "?"); got != tt.want {
+			t.Errorf("Expected %s.%s.%s=%q after reading back, got %q", tt.tbl, tt.row, tt.col, tt.want, got)
+		}
+	}
+}
+
+// To test that WriteSource() keeps CRLF line ends and a missing final line end
+func TestWriteSourceCRLF(t *testing.T) {
+	cfg, err := LoadString("crlf.cfg", "%block x\r\n{\r\n  r :: c=1; # one\r\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.EditEntry("x", "r", "c", "2")
+	cfg.EditEntry("y", "r", "c", "3")
+	var out strings.Builder
+	cfg.WriteSource(&out)
+	if want := "%block x\r\n{\r\n  r :: c=2; # one\r\n}\r\n\r\n%block y\r\n{\r\n\tr :: c=3;\r\n}\r\n"; out.String() != want {
+		t.Errorf("WriteSource gave %q, want %q", out.String(), want)
+	}
+
+	mem := newCfgBlock("mem", "")
+	if err := mem.WriteSource(&out); !errors.Is(err, ErrNoSource) {
+		t.Errorf("Expected ErrNoSource for an in-memory config, got %v", err)
+	}
+}
+
+// To test WriteSource() after Update()
+func TestUpdate(t *testing.T) {
+	cfg, err := LoadString("ours.cfg", `# top comment
+top :: a=1;   # kept
+
+%block app   # the app
+{
+    server :: host=alpha; port=80; tz=UTC;   # keep me
+           += user=bob;
+    # about old
+    old    :: x=1;
+           += y=2;
+    keep   :: k=1;
+%block gone
+{
+    g :: g=1;
+}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := LoadString("to.cfg", `
+top :: a=2; b="x y";
+%block app
+{
+    server :: port=81; user=bob;
+    keep   :: k=1;
+    new    :: n=1; m=2;
+%block sub
+{
+    s :: s=1;
+%block deep
+{
+}
+}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Update(to)
+	want := `# top comment
+top :: a=2;   # kept
+    += b=x y;
+
+%block app   # the app
+{
+    server :: port=81;   # keep me
+           += user=bob;
+    # about old
+    keep   :: k=1;
+    new :: n=1; m=2;
+
+    %block sub
+    {
+    	s :: s=1;
+
+    	%block deep
+    	{
+    	}
+    }
+}
+`
+	var out strings.Builder
+	if err := cfg.WriteSource(&out); err != nil || out.String() != want {
+		t.Fatalf("WriteSource gave %v\n%s\nwant\n%s", err, out.String(), want)
+	}
+	cfg2, err := LoadString("ours.cfg", out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := Diff(cfg2, to); len(changes) > 0 {
+		t.Errorf("Expected the source to read back as the update, got %v", changes)
+	}
+	if changes := Diff(cfg, to); len(changes) > 0 {
+		t.Errorf("Expected the config to be updated in memory, got %v", changes)
+	}
+
+	cfg, err = LoadString("ext.cfg", "%block base\n{\n  r :: a=1;\n}\n%block dev %extends base\n{\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _ = LoadString("to.cfg", "%block base\n{\n  r :: a=1;\n}\n%block dev\n{\n}\n")
+	cfg.Update(to)
+	if err := cfg.WriteSource(&out); !errors.Is(err, ErrNotInSource) {
+		t.Errorf("Expected ErrNotInSource for the removal of an inherited row, got %v", err)
+	}
+}
+
+// To test that SaveAll() writes each edit back into the file it was read from
+func TestSaveAll(t *testing.T) {
+	dir := t.TempDir()
+	main := "%include common.cfg\n%include hosts.cfg\n\n%block app\n{\n  %include app_rows.cfg\n  run :: mode=test;\n}\n"
+	common := "# shared settings\n%block common\n{\n  log :: level=info;  # default\n}\n"
+	hosts := "%block hosts\n{\n  db :: name=db1;\n}\n"
+	appRows := "limits :: max=10;\n"
+	fname := writeCfgFile(t, dir, "main.cfg", main)
+	writeCfgFile(t, dir, "common.cfg", common)
+	writeCfgFile(t, dir, "hosts.cfg", hosts)
+	writeCfgFile(t, dir, "app_rows.cfg", appRows)
+
+	cfg, err := Load(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.EditEntry("common", "log", "level", "debug")
+	cfg.EditEntry("app", "limits", "max", "20")
+	cfg.EditEntry("app", "run", "mode", "prod")
+	if err := cfg.SaveAll(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct{ name, want string }{
+		{"main.cfg", strings.Replace(main, "mode=test", "mode=prod", 1)},
+		{"common.cfg", strings.Replace(common, "level=info", "level=debug", 1)},
+		{"hosts.cfg", hosts},
+		{"app_rows.cfg", "limits :: max=20;\n"},
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, tt.name))
+		if err != nil || string(data) != tt.want {
+			t.Errorf("Expected %s to hold %q, got %q, %v", tt.name, tt.want, data, err)
+		}
+	}
+
+	cfg2, err := LoadFS(fstest.MapFS{"main.cfg": {Data: []byte("%block a\n{\n  r :: c=1;\n}\n")}}, "main.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2.EditEntry("a", "r", "c", "2")
+	if err := cfg2.SaveAll(); !errors.Is(err, ErrNoSource) {
+		t.Errorf("Expected ErrNoSource saving a config read from an fs.FS, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package qcfg
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ChangeOp tells how an element differs between the configs compared by Diff
+type ChangeOp byte
+
+// The ChangeOp values, also used as the first character of Change.String
+const (
+	Added   ChangeOp = '+'
+	Removed ChangeOp = '-'
+	Changed ChangeOp = '~'
+)
+
+// Kinds of element named by a Change
+const (
+	KindBlock  = "block"
+	KindRow    = "row"
+	KindColumn = "column"
+)
+
+// Change is one difference found by Diff.
+// A block or row that was added or removed is reported once, without listing its content
+type Change struct {
+	Op   ChangeOp
+	Kind string // KindBlock, KindRow or KindColumn
+	Path string // dotted path of the element, as in ${block.row.col}
+	Old  string // the value of a column that was removed or changed
+	New  string // the value of a column that was added or changed
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Kind != KindColumn:
+		return fmt.Sprintf("%c %s %s", c.Op, c.Kind, c.Path)
+	case c.Op == Added:
+		return fmt.Sprintf("%c %s = %q", c.Op, c.Path, c.New)
+	case c.Op == Removed:
+		return fmt.Sprintf("%c %s = %q", c.Op, c.Path, c.Old)
+	}
+	return fmt.Sprintf("%c %s = %q -> %q", c.Op, c.Path, c.Old, c.New)
+}
+
+// Diff returns the changes that turn config a into config b: those of the rows of a block, then of its nested blocks, each sorted by name.
+// Only the content counts: comments, whitespace, the order of blocks, rows and columns,
+// and which %include file an element was read from make no difference
+func Diff(a, b *CfgBlock) []Change {
+	var changes []Change
+	diffBlock(&changes, a, b, "")
+	return changes
+}
+
+// diffBlock appends to _changes the differences between the blocks a and b, whose path is _path
+func diffBlock(_changes *[]Change, a, b *CfgBlock, _path string) {
+	for _, name := range unionNames(a.rowOrder, b.rowOrder) {
+		rowa, ina := a.rows[name]
+		rowb, inb := b.rows[name]
+		switch {
+		case !inb:
+			*_changes = append(*_changes, Change{Op: Removed, Kind: KindRow, Path: _path + name})
+		case !ina:
+			*_changes = append(*_changes, Change{Op: Added, Kind: KindRow, Path: _path + name})
+		default:
+			for _, col := range unionNames(rowa.colOrder, rowb.colOrder) {
+				vala, ina := rowa.cols[col]
+				valb, inb := rowb.cols[col]
+				path := _path + name + "." + col
+				switch {
+				case !inb:
+					*_changes = append(*_changes, Change{Op: Removed, Kind: KindColumn, Path: path, Old: vala})
+				case !ina:
+					*_changes = append(*_changes, Change{Op: Added, Kind: KindColumn, Path: path, New: valb})
+				case vala != valb:
+					*_changes = append(*_changes, Change{Op: Changed, Kind: KindColumn, Path: path, Old: vala, New: valb})
+				}
+			}
+		}
+	}
+	for _, name := range unionNames(a.tblOrder, b.tblOrder) {
+		tbla, ina := a.tbls[name]
+		tblb, inb := b.tbls[name]
+		switch {
+		case !inb:
+			*_changes = append(*_changes, Change{Op: Removed, Kind: KindBlock, Path: _path + name})
+		case !ina:
+			*_changes = append(*_changes, Change{Op: Added, Kind: KindBlock, Path: _path + name})
+		default:
+			diffBlock(_changes, tbla, tblb, _path+name+".")
+		}
+	}
+}
+
+// unionNames returns the sorted names found in either a or b
+func unionNames(a, b []string) []string {
+	names := mergeNames(a, b)
+	sort.Strings(names)
+	return names
+}
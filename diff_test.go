@@ -0,0 +1,74 @@
+package qcfg
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+// To test Diff()
+func TestDiff(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.cfg": {Data: []byte(`# first layout
+%block app
+{
+    server :: host=alpha; port=80;
+    client :: id=7;
+    %block inner
+    {
+        r :: x=1;
+    }
+}
+%block old
+{
+    r :: x=1;
+}
+`)},
+		"b.cfg": {Data: []byte(`%include app.cfg
+%block new
+{
+}
+`)},
+		"app.cfg": {Data: []byte(`%block app   # moved to its own file
+{
+  %block inner
+  {
+    r :: x=2; y=3;
+  }
+  server::port = 8080; host = alpha;
+  worker :: n=4;
+}
+`)},
+	}
+	a, err := LoadFS(fsys, "a.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadFS(fsys, "b.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := Diff(a, a); len(changes) != 0 {
+		t.Errorf("Expected no changes between a config and itself, got %v", changes)
+	}
+	want := []string{
+		`- row app.client`,
+		`~ app.server.port = "80" -> "8080"`,
+		`+ row app.worker`,
+		`~ app.inner.r.x = "1" -> "2"`,
+		`+ app.inner.r.y = "3"`,
+		`+ block new`,
+		`- block old`,
+	}
+	changes := Diff(a, b)
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %v", len(want), changes)
+	}
+	for ii, cc := range changes {
+		if cc.String() != want[ii] {
+			t.Errorf("Expected change %d to be %s, got %s", ii, want[ii], cc)
+		}
+	}
+	if changes[1].Op != Changed || changes[1].Kind != KindColumn || changes[1].Old != "80" || changes[1].New != "8080" {
+		t.Errorf("Unexpected fields for %s: %+v", changes[1], changes[1])
+	}
+}
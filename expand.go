@@ -0,0 +1,261 @@
+package qcfg
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors reported (wrapped in a *RefError) for a ${block.row.col} cross-reference that cannot be resolved
+var (
+	ErrDanglingRef = errors.New("reference to missing cell")
+	ErrRefCycle    = errors.New("reference cycle")
+)
+
+// UnsetVarError reports a ${VAR:?message} whose VAR is unset or empty
+type UnsetVarError struct {
+	Name string
+	Msg  string
+}
+
+func (e *UnsetVarError) Error() string {
+	if e.Msg == "" {
+		return e.Name + ": parameter null or not set"
+	}
+	return e.Name + ": " + e.Msg
+}
+
+// RefError reports a ${block.row.col} cross-reference that cannot be resolved
+type RefError struct {
+	Refs []string // the references followed, ending with the one that failed
+	Err  error    // ErrDanglingRef or ErrRefCycle
+}
+
+func (e *RefError) Error() string {
+	return e.Err.Error() + ": " + strings.Join(e.Refs, " -> ")
+}
+
+// Unwrap allows errors.Is to match ErrDanglingRef and ErrRefCycle
+func (e *RefError) Unwrap() error { return e.Err }
+
+// varExpander substitutes ${NAME} within strings.
+// Like the shell, ${NAME:-default} gives default when NAME is unset or empty, ${NAME:?message} fails with an *UnsetVarError
+type varExpander struct {
+	lookup func(string) (string, bool, error) // value of NAME, false when unset
+	keep   func(string) bool                  // when not nil, names whose ${...} is copied unchanged
+	strict func(string) error                 // when not nil, the error for a plain ${NAME} that is unset, otherwise it gives ""
+}
+
+// isRefName reports whether a ${NAME} is a cross-reference to another cell (block.row.col) rather than a variable
+func isRefName(_name string) bool {
+	return strings.Contains(_name, ".")
+}
+
+// expand substitutes each ${...} in _s, a "${" without its closing "}" is copied unchanged
+func (ve *varExpander) expand(_s string) (string, error) {
+	if !strings.Contains(_s, "${") {
+		return _s, nil
+	}
+	var out strings.Builder
+	for {
+		nn := strings.Index(_s, "${")
+		if nn < 0 {
+			break
+		}
+		end := matchBrace(_s, nn+2)
+		if end < 0 {
+			break
+		}
+		out.WriteString(_s[:nn])
+		val, err := ve.expandVar(_s[nn : end+1])
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(val)
+		_s = _s[end+1:]
+	}
+	out.WriteString(_s)
+	return out.String(), nil
+}
+
+// expandVar returns the value of one "${...}"
+func (ve *varExpander) expandVar(_ref string) (string, error) {
+	expr := _ref[2 : len(_ref)-1]
+	name, op, arg := expr, "", ""
+	if nn := strings.Index(expr, ":"); nn >= 0 && nn+1 < len(expr) && (expr[nn+1] == '-' || expr[nn+1] == '?') {
+		name, op, arg = expr[:nn], expr[nn:nn+2], expr[nn+2:]
+	}
+	name = strings.TrimSpace(name)
+	if ve.keep != nil && ve.keep(name) {
+		return _ref, nil
+	}
+	val, ok, err := ve.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if ok && val != "" {
+		return val, nil
+	}
+	switch op {
+	case ":-":
+		return ve.expand(arg)
+	case ":?":
+		msg, err := ve.expand(arg)
+		if err != nil {
+			return "", err
+		}
+		return "", &UnsetVarError{name, msg}
+	}
+	if !ok && ve.strict != nil {
+		return "", ve.strict(name)
+	}
+	return val, nil
+}
+
+// matchBrace returns the index of the "}" closing the "${" that ends just before _start, or -1
+func matchBrace(_s string, _start int) int {
+	depth := 1
+	for ii := _start; ii < len(_s); ii++ {
+		switch {
+		case _s[ii] == '$' && ii+1 < len(_s) && _s[ii+1] == '{':
+			depth++
+			ii++
+		case _s[ii] == '}':
+			depth--
+			if depth == 0 {
+				return ii
+			}
+		}
+	}
+	return -1
+}
+
+// cellKey identifies a column within a loaded config
+type cellKey struct {
+	blk *CfgBlock
+	row string
+	col string
+}
+
+// pendingRef is a column whose value holds cross-references, to be resolved once loading is complete
+type pendingRef struct {
+	key  cellKey
+	pos  ParseError // where the value was defined, for reporting
+	done bool       // resolved, or dropped as the cell was declared again
+}
+
+// addRef records the cross-references of a cell, to be resolved by finish
+func (p *parser) addRef(_pr *pendingRef) {
+	if p.pending == nil {
+		p.pending = make(map[cellKey]*pendingRef)
+	}
+	p.refs = append(p.refs, _pr)
+	p.pending[_pr.key] = _pr
+}
+
+// dropRef forgets the cross-references of the cell _key, whose value is replaced or removed
+func (p *parser) dropRef(_key cellKey) {
+	if pr := p.pending[_key]; pr != nil {
+		pr.done = true
+		delete(p.pending, _key)
+	}
+}
+
+// refResolver substitutes ${block.row.col} cross-references once the whole tree is loaded
+type refResolver struct {
+	root    *CfgBlock
+	pending map[cellKey]*pendingRef
+	paths   map[*CfgBlock]string // dotted path of each block below root
+}
+
+// resolveRefs resolves the cross-references of every pending cell in turn, returning the problems found
+func resolveRefs(_root *CfgBlock, _refs []*pendingRef) ErrorList {
+	if len(_refs) < 1 {
+		return nil
+	}
+	rr := refResolver{_root, make(map[cellKey]*pendingRef, len(_refs)), make(map[*CfgBlock]string)}
+	for _, pr := range _refs {
+		rr.pending[pr.key] = pr
+	}
+	rr.walk(_root, "")
+	var errs ErrorList
+	for _, pr := range _refs {
+		if err := rr.resolveCell(pr, nil); err != nil {
+			perr := pr.pos
+			perr.Err = err
+			errs = append(errs, &perr)
+		}
+	}
+	return errs
+}
+
+func (rr *refResolver) walk(_blk *CfgBlock, _path string) {
+	rr.paths[_blk] = _path
+	for name, tbl := range _blk.tbls {
+		rr.walk(tbl, _path+name+".")
+	}
+}
+
+// resolveCell substitutes the cross-references within a pending cell, _stack holds the references being resolved
+func (rr *refResolver) resolveCell(_pr *pendingRef, _stack []string) error {
+	if _pr.done {
+		return nil
+	}
+	if _, ok := rr.paths[_pr.key.blk]; !ok {
+		return nil // within a block that was replaced or deleted
+	}
+	row, ok := _pr.key.blk.rows[_pr.key.row]
+	if !ok {
+		return nil
+	}
+	val, ok := row.cols[_pr.key.col]
+	if !ok {
+		return nil
+	}
+	stack := append(append([]string{}, _stack...), rr.paths[_pr.key.blk]+_pr.key.row+"."+_pr.key.col)
+	ve := varExpander{
+		lookup: func(_ref string) (string, bool, error) {
+			return rr.lookup(_ref, stack)
+		},
+		keep: func(_name string) bool { return !isRefName(_name) },
+		strict: func(_ref string) error {
+			return &RefError{append(stack, _ref), ErrDanglingRef}
+		},
+	}
+	val, err := ve.expand(val)
+	_pr.done = true // also on failure, so that a cycle is reported only once
+	if err != nil {
+		return err
+	}
+	row.cols[_pr.key.col] = val
+	return nil
+}
+
+// lookup returns the resolved value of the cell named by _ref, which is "row.col" or "block.[block.]row.col"
+func (rr *refResolver) lookup(_ref string, _stack []string) (string, bool, error) {
+	parts := strings.Split(_ref, ".")
+	blk := rr.root
+	for _, name := range parts[:len(parts)-2] {
+		if blk = blk.tbls[name]; blk == nil {
+			return "", false, nil
+		}
+	}
+	row, col := parts[len(parts)-2], parts[len(parts)-1]
+	if _, ok := blk.rows[row]; !ok {
+		return "", false, nil
+	}
+	if _, ok := blk.rows[row].cols[col]; !ok {
+		return "", false, nil
+	}
+	if pr, ok := rr.pending[cellKey{blk, row, col}]; ok && !pr.done {
+		path := rr.paths[blk] + row + "." + col
+		for _, ss := range _stack {
+			if ss == path {
+				return "", false, &RefError{append(_stack, path), ErrRefCycle}
+			}
+		}
+		if err := rr.resolveCell(pr, _stack); err != nil {
+			return "", false, err
+		}
+	}
+	return blk.rows[row].cols[col], true, nil
+}
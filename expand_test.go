@@ -0,0 +1,35 @@
+package qcfg
+
+import (
+	"errors"
+	"testing"
+)
+
+// To test varExpander.expand()
+func TestExpandVars(t *testing.T) {
+	env := map[string]string{"HOST": "db1", "EMPTY": "", "PORT": "5432"}
+	ve := varExpander{lookup: func(name string) (string, bool, error) {
+		val, ok := env[name]
+		return val, ok, nil
+	}}
+	tests := []struct{ in, want string }{
+		{"plain", "plain"},
+		{"${HOST}:${PORT}", "db1:5432"},
+		{"${MISSING}x", "x"},
+		{"${MISSING:-localhost}", "localhost"},
+		{"${EMPTY:-${HOST}}", "db1"},
+		{"${HOST:-other}", "db1"},
+		{"$HOST ${HOST", "$HOST ${HOST"},
+	}
+	for _, tt := range tests {
+		got, err := ve.expand(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("expand(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	_, err := ve.expand("${MISSING:?must set MISSING}")
+	var verr *UnsetVarError
+	if !errors.As(err, &verr) || verr.Name != "MISSING" || verr.Msg != "must set MISSING" {
+		t.Errorf("Expected an UnsetVarError for MISSING, got %v", err)
+	}
+}
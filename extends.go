@@ -0,0 +1,120 @@
+package qcfg
+
+import "strings"
+
+// extension is a block declared with "%block name %extends parent", to be resolved once loading is complete
+type extension struct {
+	blk    *CfgBlock
+	scope  *CfgBlock // the block holding blk, where parent is looked for first
+	parent string    // name of a block within scope, or dotted path from the top-level block
+	pos    ParseError
+}
+
+// resolveExtends copies into each block declared with %extends what it does not define itself of its parent block.
+// A parent that extends another block, or holds blocks that do, is resolved first
+func (p *parser) resolveExtends(_root *CfgBlock) {
+	if len(p.extends) < 1 {
+		return
+	}
+	state := make(map[*extension]int) // 1 while being resolved, 2 once done
+	var resolve func(*extension) bool
+	resolve = func(_ext *extension) bool {
+		switch state[_ext] {
+		case 1:
+			p.extendError(_ext, ErrExtendsCycle)
+			return false
+		case 2:
+			return true
+		}
+		state[_ext] = 1
+		defer func() { state[_ext] = 2 }()
+		// blocks holding the parent may get it only once they inherit themselves, as dev does dev.sub
+		ancestors := func(_path string) bool {
+			for _, other := range p.extends {
+				path := p.paths[other.blk]
+				if path != "" && len(path) < len(_path) && strings.HasPrefix(_path, path) && !resolve(other) {
+					return false
+				}
+			}
+			return true
+		}
+		parent := _ext.scope.tbls[_ext.parent]
+		if parent == nil {
+			if !ancestors(p.paths[_ext.scope] + _ext.parent + ".") {
+				return false
+			}
+			parent = _ext.scope.tbls[_ext.parent]
+		}
+		if parent == nil {
+			if !ancestors(_ext.parent + ".") {
+				return false
+			}
+			parent = lookupBlock(_root, strings.Split(_ext.parent, "."))
+		}
+		if parent == nil {
+			p.extendError(_ext, ErrUnknownBlock)
+			return false
+		}
+		for _, other := range p.extends {
+			if (other.blk == parent || p.paths[parent] != "" && strings.HasPrefix(p.paths[other.blk], p.paths[parent])) && !resolve(other) {
+				return false
+			}
+		}
+		p.inherit(_ext.blk, parent)
+		return true
+	}
+	for _, ext := range p.extends {
+		resolve(ext)
+	}
+}
+
+// extendError records a problem with the %extends of _ext
+func (p *parser) extendError(_ext *extension, _err error) {
+	perr := _ext.pos
+	perr.Err = _err
+	p.errs = append(p.errs, &perr)
+}
+
+// lookupBlock returns the block at _path below _blk, nil when there is none
+func lookupBlock(_blk *CfgBlock, _path []string) *CfgBlock {
+	for _, name := range _path {
+		if _blk = _blk.tbls[name]; _blk == nil {
+			return nil
+		}
+	}
+	return _blk
+}
+
+// inherit copies into _child the rows, columns and nested blocks of _parent that it does not define itself,
+// those of _parent coming first in the declaration order. Copied values holding cross-references are resolved as the originals
+func (p *parser) inherit(_child, _parent *CfgBlock) {
+	for _, name := range _parent.rowOrder {
+		prow := _parent.rows[name]
+		row, ok := _child.rows[name]
+		if !ok {
+			row = newCfgRow(name)
+			_child.rows[name] = row
+		}
+		for _, col := range prow.colOrder {
+			if _, ok := row.cols[col]; ok {
+				continue
+			}
+			row.cols[col] = prow.cols[col]
+			if pr := p.pending[cellKey{_parent, name, col}]; pr != nil {
+				p.addRef(&pendingRef{key: cellKey{_child, name, col}, pos: pr.pos})
+			}
+		}
+		row.colOrder = mergeNames(prow.colOrder, row.colOrder)
+	}
+	_child.rowOrder = mergeNames(_parent.rowOrder, _child.rowOrder)
+	for _, name := range _parent.tblOrder {
+		tbl, ok := _child.tbls[name]
+		if !ok {
+			tbl = newCfgBlock(name, _parent.tbls[name].fname)
+			_child.tbls[name] = tbl
+			p.paths[tbl] = p.paths[_child] + name + "."
+		}
+		p.inherit(tbl, _parent.tbls[name])
+	}
+	_child.tblOrder = mergeNames(_parent.tblOrder, _child.tblOrder)
+}
@@ -0,0 +1,194 @@
+package qcfg
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+)
+
+// FormatWidth is the line width beyond which Format wraps the columns of a row onto "+=" continuation lines
+const FormatWidth = 100
+
+// fmtIndent indents each level of nested blocks in the output of Format
+const fmtIndent = "    "
+
+// Kinds of line seen by Format
+const (
+	fmtBlank = iota
+	fmtOther // a comment, directive, "%block", "{" or "}", or a row that is kept as is
+	fmtRow
+	fmtCont // a "+=" line continuing the row above
+)
+
+// fmtLine is a line of config text being formatted, with the lines of any heredoc value it holds
+type fmtLine struct {
+	kind    int
+	depth   int      // nesting level of blocks
+	text    string   // the trimmed line, for fmtOther
+	name    string   // the row name, for fmtRow
+	op      string   // the "::" or "+=" following the row name
+	cols    []string // the name=value columns, values as written in the source
+	comment string
+	width   int // the width to which the row names around are aligned
+}
+
+// Format returns config text _src laid out canonically: nested blocks indented by four blanks per level,
+// the "::" of consecutive rows aligned, columns written as "name=value;" separated by a blank,
+// and rows longer than FormatWidth wrapped onto "+=" continuation lines lined up under the "::".
+// Comments, quoting and heredoc values are kept, runs of blank lines are reduced to one.
+// Includes are not followed and ${...} is not substituted. Formatting formatted text changes nothing
+func Format(_src []byte) ([]byte, error) {
+	eol := "\n"
+	if nn := bytes.IndexByte(_src, '\n'); nn > 0 && _src[nn-1] == '\r' {
+		eol = "\r\n"
+	}
+	rdr := bufio.NewReader(bytes.NewReader(_src))
+	lineNo := 0
+	next := func() ([]byte, bool) {
+		buf, err := rdr.ReadBytes('\n')
+		if err != nil && len(buf) < 1 {
+			return nil, false
+		}
+		lineNo++
+		return buf, true
+	}
+
+	var lines []*fmtLine
+	depth := 0
+	for {
+		raw, ok := next()
+		if !ok {
+			break
+		}
+		trimmed := bytes.TrimSpace(raw)
+		buf := bytes.TrimRight(raw, "\r\n")
+		cleanLine(&buf)
+		line := &fmtLine{kind: fmtOther, depth: depth, text: string(trimmed)}
+		switch {
+		case len(trimmed) < 1:
+			line.kind = fmtBlank
+		case len(buf) < 1 || buf[0] == '%':
+		case lineIsBlockEnd(buf):
+			if depth > 0 {
+				depth--
+			}
+			line.depth = depth
+		case buf[0] == '{':
+			depth++
+		default:
+			lead := len(raw) - len(bytes.TrimLeft(raw, " \t"))
+			start, kind := 0, fmtCont
+			if !bytes.HasPrefix(buf, []byte("+=")) {
+				if start, _ = splitRow(buf); start < 0 {
+					break
+				}
+				line.name, line.op, kind = string(bytes.Trim(buf[:start], " \t")), string(buf[start:start+2]), fmtRow
+			}
+			text, cols, comment, err := fmtCols(raw, lead+start+2, next)
+			if err != nil {
+				return nil, &ParseError{"", lineNo, 1, string(buf), nil, err}
+			}
+			if cols == nil {
+				line.text = strings.TrimSpace(string(text))
+				break
+			}
+			line.kind, line.cols, line.comment = kind, cols, comment
+		}
+		lines = append(lines, line)
+	}
+
+	// align the "::" of each run of rows at the same depth, comments between them included
+	for ii := 0; ii < len(lines); {
+		if lines[ii].kind != fmtRow {
+			ii++
+			continue
+		}
+		jj, width := ii, 0
+		for ; jj < len(lines) && lines[jj].depth == lines[ii].depth && (lines[jj].kind != fmtBlank && (lines[jj].kind != fmtOther || strings.HasPrefix(lines[jj].text, "#"))); jj++ {
+			if lines[jj].kind == fmtRow && len(lines[jj].name) > width {
+				width = len(lines[jj].name)
+			}
+		}
+		for ; ii < jj; ii++ {
+			lines[ii].width = width
+		}
+	}
+
+	var out strings.Builder
+	blank := false
+	contIndent := ""
+	for _, line := range lines {
+		if line.kind == fmtBlank {
+			blank = out.Len() > 0
+			continue
+		}
+		if blank {
+			out.WriteString(eol)
+			blank = false
+		}
+		indent := strings.Repeat(fmtIndent, line.depth)
+		switch line.kind {
+		case fmtRow:
+			contIndent = indent + strings.Repeat(" ", line.width+1) + "+= "
+			fmtWrap(&out, indent+line.name+strings.Repeat(" ", line.width-len(line.name)+1)+line.op+" ", contIndent, line, eol)
+		case fmtCont:
+			if contIndent == "" {
+				contIndent = indent + fmtIndent + "+= "
+			}
+			fmtWrap(&out, contIndent, contIndent, line, eol)
+		default:
+			contIndent = ""
+			out.WriteString(indent + line.text + eol)
+		}
+	}
+	return []byte(out.String()), nil
+}
+
+// fmtCols scans the columns of the row line _raw from _start, as scanCols does, returning the line extended by any heredoc,
+// each column as "name=value" with the value as written, and the trailing comment.
+// The columns are nil when the line holds anything else, so that it is kept as is
+func fmtCols(_raw []byte, _start int, _next func() ([]byte, bool)) ([]byte, []string, string, error) {
+	tokens, text, err := scanCols(_raw, _start, _next)
+	if err != nil {
+		return text, nil, "", err
+	}
+	cols := []string{}
+	prev := _start
+	for _, tok := range tokens {
+		head := bytes.TrimRight(bytes.TrimLeft(text[prev:tok.from], " \t;"), " \t")
+		if !bytes.HasSuffix(head, []byte("=")) || string(bytes.Trim(head[:len(head)-1], " \t")) != tok.name {
+			return text, nil, "", nil
+		}
+		cols = append(cols, tok.name+"="+string(text[tok.from:tok.to]))
+		prev = tok.to
+	}
+	rest := bytes.TrimSpace(bytes.TrimLeft(text[prev:], " \t;"))
+	if len(rest) > 0 && rest[0] != '#' {
+		return text, nil, "", nil
+	}
+	return text, cols, string(rest), nil
+}
+
+// fmtWrap writes the columns and comment of line after _prefix, starting a new line with _contPrefix
+// each time the next column would go beyond FormatWidth
+func fmtWrap(_out *strings.Builder, _prefix, _contPrefix string, _line *fmtLine, _eol string) {
+	text := _prefix
+	nn := 0
+	for _, col := range _line.cols {
+		width := len(text) - strings.LastIndex(text, "\n") - 1
+		if first := strings.SplitN(col, "\n", 2)[0]; nn > 0 && width+1+len(first)+1 > FormatWidth {
+			_out.WriteString(text + _eol)
+			text, nn = _contPrefix, 0
+		}
+		if nn > 0 {
+			text += " "
+		}
+		text += col + ";"
+		nn++
+	}
+	text = strings.TrimRight(text, " ")
+	if _line.comment != "" {
+		text += " " + _line.comment
+	}
+	_out.WriteString(text + _eol)
+}
@@ -0,0 +1,101 @@
+package qcfg
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// To test Format()
+func TestFormat(t *testing.T) {
+	src := `
+
+%block app   # the app
+{
+  server::host = alpha ;port=80   ;# main
+     +=   user = "bob smith";
+  longname  :: a=1;
+%block inner
+{
+		query :: sql=<<EOT
+  select 1
+EOT; db = main;
+   # spare :: x=1;
+		r :: junk here; a=1;
+}
+}
+
+
+%include   other.cfg
+wide :: c01=aaaaaaaaaa; c02=aaaaaaaaaa; c03=aaaaaaaaaa; c04=aaaaaaaaaa; c05=aaaaaaaaaa; c06=aaaaaaaaaa; c07=aaaaaaaaaa;
+`
+	want := `%block app   # the app
+{
+    server   :: host=alpha; port=80; # main
+             += user="bob smith";
+    longname :: a=1;
+    %block inner
+    {
+        query :: sql=<<EOT
+  select 1
+EOT; db=main;
+        # spare :: x=1;
+        r :: junk here; a=1;
+    }
+}
+
+%include   other.cfg
+wide :: c01=aaaaaaaaaa; c02=aaaaaaaaaa; c03=aaaaaaaaaa; c04=aaaaaaaaaa; c05=aaaaaaaaaa;
+     += c06=aaaaaaaaaa; c07=aaaaaaaaaa;
+`
+	out, err := Format([]byte(src))
+	if err != nil || string(out) != want {
+		t.Fatalf("Format gave %v\n%s\nwant\n%s", err, out, want)
+	}
+	if again, err := Format(out); err != nil || string(again) != string(out) {
+		t.Errorf("Expected formatting to be idempotent, got %v\n%s", err, again)
+	}
+
+	if _, err := Format([]byte("%block a\n{\n  r :: c=\"open;\n}\n")); !errors.Is(err, ErrUnterminatedQuote) {
+		t.Errorf("Expected ErrUnterminatedQuote, got %v", err)
+	}
+	if out, _ := Format([]byte("%block a\r\n{\r\nr::c=1\r\n}\r\n")); string(out) != "%block a\r\n{\r\n    r :: c=1;\r\n}\r\n" {
+		t.Errorf("Expected CRLF line ends to be kept, got %q", out)
+	}
+}
+
+// To test that Format() leaves the meaning of the sample configs unchanged
+func TestFormatSamples(t *testing.T) {
+	fsys, formatted := fstest.MapFS{}, fstest.MapFS{}
+	for _, name := range []string{"_sample.cfg", "_sample2.cfg", "_sample3.cfg"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := Format(data)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if again, _ := Format(out); string(again) != string(out) {
+			t.Errorf("Expected formatting %s to be idempotent", name)
+		}
+		if strings.Count(string(out), "#") != strings.Count(string(data), "#") {
+			t.Errorf("Expected the comments of %s to be kept", name)
+		}
+		fsys[name] = &fstest.MapFile{Data: data}
+		formatted[name] = &fstest.MapFile{Data: out}
+	}
+	cfg, err := LoadFS(fsys, "_sample.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2, err := LoadFS(formatted, "_sample.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isTreeEqual(cfg, cfg2) {
+		t.Error("Expected the formatted samples to read back the same")
+	}
+}
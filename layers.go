@@ -0,0 +1,145 @@
+package qcfg
+
+import "fmt"
+
+// Layers stacks configs so that each cell is looked up in the highest layer that defines it,
+// e.g. a base config overridden by region, host and command-line configs.
+// Layers are only read, a cell missing from every layer gives the default
+type Layers struct {
+	cfgs []*CfgBlock // lowest layer first
+}
+
+// NewLayers stacks _cfgs, the first being the lowest layer
+func NewLayers(_cfgs ...*CfgBlock) *Layers {
+	return &Layers{append([]*CfgBlock{}, _cfgs...)}
+}
+
+// Push adds _cfg as the new highest layer
+func (ls *Layers) Push(_cfg *CfgBlock) {
+	ls.cfgs = append(ls.cfgs, _cfg)
+}
+
+// Layer returns the layer at index _nn, 0 being the lowest
+func (ls *Layers) Layer(_nn int) *CfgBlock {
+	return ls.cfgs[_nn]
+}
+
+// Len returns the number of layers
+func (ls *Layers) Len() int {
+	return len(ls.cfgs)
+}
+
+// Which returns the index of the layer that supplies the column _col of row _row within the nested blocks _tbls,
+// or -1 when no layer defines it
+func (ls *Layers) Which(_tbls []string, _row, _col string) int {
+	_, nn := ls.lookup(_tbls, _row, _col)
+	return nn
+}
+
+// lookup returns the value of a cell from the highest layer defining it, and the index of that layer, -1 when none does
+func (ls *Layers) lookup(_tbls []string, _row, _col string) (string, int) {
+	for nn := len(ls.cfgs) - 1; nn >= 0; nn-- {
+		blk := ls.cfgs[nn]
+		for _, tbl := range _tbls {
+			if blk = blk.tbls[tbl]; blk == nil {
+				break
+			}
+		}
+		if blk == nil {
+			continue
+		}
+		if row, ok := blk.rows[_row]; ok {
+			if val, ok := row.cols[_col]; ok {
+				return val, nn
+			}
+		}
+	}
+	return "", -1
+}
+
+// Str applies CfgBlock.Str() to the highest layer defining the element
+func (ls *Layers) Str(_tbl, _row, _col string, _def string) string {
+	return ls.NestedStr([]string{_tbl}, _row, _col, _def)
+}
+
+// NestedStr applies CfgBlock.NestedStr() to the highest layer defining the element, no _tbls for a top-level row
+func (ls *Layers) NestedStr(_tbls []string, _row, _col string, _def string) string {
+	val, nn := ls.lookup(_tbls, _row, _col)
+	if nn < 0 {
+		return _def
+	}
+	return val
+}
+
+// Int applies CfgBlock.Int() to the highest layer defining the element
+func (ls *Layers) Int(_tbl, _row, _col string, _def int) int {
+	return ls.NestedInt([]string{_tbl}, _row, _col, _def)
+}
+
+// NestedInt applies CfgBlock.NestedInt() to the highest layer defining the element
+func (ls *Layers) NestedInt(_tbls []string, _row, _col string, _def int) int {
+	ival := _def
+	if val, nn := ls.lookup(_tbls, _row, _col); nn >= 0 {
+		fmt.Sscanf(val, "%d", &ival)
+	}
+	return ival
+}
+
+// Int64 applies CfgBlock.Int64() to the highest layer defining the element
+func (ls *Layers) Int64(_tbl, _row, _col string, _def int64) int64 {
+	return ls.NestedInt64([]string{_tbl}, _row, _col, _def)
+}
+
+// NestedInt64 applies CfgBlock.NestedInt64() to the highest layer defining the element
+func (ls *Layers) NestedInt64(_tbls []string, _row, _col string, _def int64) int64 {
+	ival := _def
+	if val, nn := ls.lookup(_tbls, _row, _col); nn >= 0 {
+		fmt.Sscanf(val, "%d", &ival)
+	}
+	return ival
+}
+
+// Float64 applies CfgBlock.Float64() to the highest layer defining the element
+func (ls *Layers) Float64(_tbl, _row, _col string, _def float64) float64 {
+	return ls.NestedFloat64([]string{_tbl}, _row, _col, _def)
+}
+
+// NestedFloat64 applies CfgBlock.NestedFloat64() to the highest layer defining the element
+func (ls *Layers) NestedFloat64(_tbls []string, _row, _col string, _def float64) float64 {
+	fval := _def
+	if val, nn := ls.lookup(_tbls, _row, _col); nn >= 0 {
+		fmt.Sscanf(val, "%g", &fval)
+	}
+	return fval
+}
+
+// Flatten returns a single config holding every cell, each with the value of the highest layer defining it
+func (ls *Layers) Flatten() *CfgBlock {
+	out := newCfgBlock("", "")
+	for _, cfg := range ls.cfgs {
+		overlay(out, cfg)
+	}
+	return out
+}
+
+// overlay copies each cell of _src into _dst, replacing those already there
+func overlay(_dst, _src *CfgBlock) {
+	for _, name := range _src.rowOrder {
+		row, ok := _dst.rows[name]
+		if !ok {
+			row = newCfgRow(name)
+			_dst.setRow(row)
+		}
+		for _, col := range _src.rows[name].colOrder {
+			row.setCol(col, _src.rows[name].cols[col])
+		}
+	}
+	for _, name := range _src.tblOrder {
+		tbl, ok := _dst.tbls[name]
+		if !ok {
+			tbl = newCfgBlock(name, _src.tbls[name].fname)
+			_dst.setBlock(name, tbl)
+		}
+		overlay(tbl, _src.tbls[name])
+	}
+}
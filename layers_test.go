@@ -0,0 +1,65 @@
+package qcfg
+
+import (
+	"testing"
+)
+
+// To test Layers
+func TestLayers(t *testing.T) {
+	load := func(text string) *CfgBlock {
+		cfg, err := LoadString("test.cfg", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	base := load("top :: debug=0;\n%block db\n{\n  primary :: host=db1; port=5432; timeout=1.5;\n  %block pool\n  {\n    size :: max=10;\n  }\n}\n")
+	region := load("%block db\n{\n  primary :: host=db-nam;\n}\n")
+	host := load("top :: debug=1;\n%block db\n{\n  %block pool\n  {\n    size :: max=20;\n  }\n}\n")
+	ls := NewLayers(base, region)
+	ls.Push(host)
+
+	if got := ls.Str("db", "primary", "host", ""); got != "db-nam" {
+		t.Errorf("Expected host from the region layer, got %q", got)
+	}
+	if got := ls.Int("db", "primary", "port", 0); got != 5432 {
+		t.Errorf("Expected port from the base layer, got %d", got)
+	}
+	if got := ls.Float64("db", "primary", "timeout", 0); got != 1.5 {
+		t.Errorf("Expected timeout 1.5, got %g", got)
+	}
+	if got := ls.NestedInt([]string{"db", "pool"}, "size", "max", 0); got != 20 {
+		t.Errorf("Expected max from the host layer, got %d", got)
+	}
+	if got := ls.NestedStr(nil, "top", "debug", ""); got != "1" {
+		t.Errorf("Expected a top-level row from the host layer, got %q", got)
+	}
+	if got := ls.Str("db", "primary", "user", "nobody"); got != "nobody" {
+		t.Errorf("Expected the default for a missing cell, got %q", got)
+	}
+
+	for _, tt := range []struct {
+		tbls     []string
+		row, col string
+		want     int
+	}{
+		{[]string{"db"}, "primary", "host", 1},
+		{[]string{"db"}, "primary", "port", 0},
+		{[]string{"db", "pool"}, "size", "max", 2},
+		{[]string{"db"}, "primary", "user", -1},
+		{[]string{"nosuch"}, "primary", "host", -1},
+	} {
+		if got := ls.Which(tt.tbls, tt.row, tt.col); got != tt.want {
+			t.Errorf("Expected %v %s.%s from layer %d, got %d", tt.tbls, tt.row, tt.col, tt.want, got)
+		}
+	}
+	if ls.Len() != 3 || ls.Layer(1) != region {
+		t.Error("Expected the layers in the order stacked")
+	}
+
+	flat := ls.Flatten()
+	if flat.Str("db", "primary", "host", "") != "db-nam" || flat.Str("db", "primary", "port", "") != "5432" ||
+		flat.NestedInt([]string{"db", "pool"}, "size", "max", 0) != 20 {
+		t.Error("Expected Flatten to hold the value of the highest layer of each cell")
+	}
+}
@@ -0,0 +1,174 @@
+package qcfg
+
+import "fmt"
+
+// Conflict is an element changed differently by both sides of a Merge.
+// Ours and Theirs are the changes each side made to it from the base, as Diff reports them
+type Conflict struct {
+	Ours   Change
+	Theirs Change
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("conflict in %s %s: ours %s, theirs %s", c.Ours.Kind, c.Ours.Path, c.Ours.describe(), c.Theirs.describe())
+}
+
+// describe returns what the change did, without its path
+func (c Change) describe() string {
+	switch {
+	case c.Kind != KindColumn && c.Op == Added:
+		return "added"
+	case c.Kind != KindColumn && c.Op == Removed:
+		return "removed"
+	case c.Kind != KindColumn:
+		return "changed"
+	case c.Op == Added:
+		return fmt.Sprintf("added %q", c.New)
+	case c.Op == Removed:
+		return fmt.Sprintf("removed %q", c.Old)
+	}
+	return fmt.Sprintf("%q -> %q", c.Old, c.New)
+}
+
+// Merge combines the changes made from the config base by ours and by theirs, column by column:
+// a column changed, added or removed on one side only takes that side's value, as it does when both sides agree.
+// A column given different values by each side is a conflict, as is a row or block removed on one side and changed on the other.
+// For a conflict the result keeps the value of ours, or the changed row or block, and the conflict is reported.
+// The result is a new config, in the order of ours with the additions of theirs after
+func Merge(base, ours, theirs *CfgBlock) (*CfgBlock, []Conflict) {
+	var conflicts []Conflict
+	out := mergeBlock(&conflicts, base, ours, theirs, "")
+	return out, conflicts
+}
+
+// mergeBlock merges the blocks ours and theirs, at path _path, from base, which is nil when both added the block
+func mergeBlock(_conflicts *[]Conflict, base, ours, theirs *CfgBlock, _path string) *CfgBlock {
+	if base == nil {
+		base = newCfgBlock(ours.name, "")
+	}
+	out := newCfgBlock(ours.name, ours.fname)
+	for _, name := range mergeNames(ours.rowOrder, theirs.rowOrder) {
+		rowb, rowo, rowt := base.rows[name], ours.rows[name], theirs.rows[name]
+		switch {
+		case rowo != nil && rowt != nil:
+			out.setRow(mergeRow(_conflicts, rowb, rowo, rowt, _path+name))
+		case rowb == nil && rowo != nil:
+			out.setRow(rowo.clone())
+		case rowb == nil:
+			out.setRow(rowt.clone())
+		default:
+			kept, keptByOurs := rowo, true
+			if kept == nil {
+				kept, keptByOurs = rowt, false
+			}
+			if isRowEqual(rowb, kept) {
+				continue // removed by the other side
+			}
+			*_conflicts = append(*_conflicts, removedChanged(KindRow, _path+name, keptByOurs))
+			out.setRow(kept.clone())
+		}
+	}
+	for _, name := range mergeNames(ours.tblOrder, theirs.tblOrder) {
+		tblb, tblo, tblt := base.tbls[name], ours.tbls[name], theirs.tbls[name]
+		switch {
+		case tblo != nil && tblt != nil:
+			out.setBlock(name, mergeBlock(_conflicts, tblb, tblo, tblt, _path+name+"."))
+		case tblb == nil && tblo != nil:
+			out.setBlock(name, tblo.clone())
+		case tblb == nil:
+			out.setBlock(name, tblt.clone())
+		default:
+			kept, keptByOurs := tblo, true
+			if kept == nil {
+				kept, keptByOurs = tblt, false
+			}
+			if len(Diff(tblb, kept)) < 1 {
+				continue // removed by the other side
+			}
+			*_conflicts = append(*_conflicts, removedChanged(KindBlock, _path+name, keptByOurs))
+			out.setBlock(name, kept.clone())
+		}
+	}
+	return out
+}
+
+// mergeRow merges the columns of the rows ours and theirs, at path _path, from base, which is nil when both added the row
+func mergeRow(_conflicts *[]Conflict, base, ours, theirs *cfgRow, _path string) *cfgRow {
+	if base == nil {
+		base = newCfgRow(ours.name)
+	}
+	out := newCfgRow(ours.name)
+	for _, col := range mergeNames(ours.colOrder, theirs.colOrder, base.colOrder) {
+		valb, inBase := base.cols[col]
+		valo, inOurs := ours.cols[col]
+		valt, inTheirs := theirs.cols[col]
+		switch {
+		case inOurs == inTheirs && valo == valt, inBase == inTheirs && valb == valt:
+			if inOurs {
+				out.setCol(col, valo)
+			}
+		case inBase == inOurs && valb == valo:
+			if inTheirs {
+				out.setCol(col, valt)
+			}
+		default:
+			path := _path + "." + col
+			*_conflicts = append(*_conflicts, Conflict{colChange(path, valb, inBase, valo, inOurs), colChange(path, valb, inBase, valt, inTheirs)})
+			if inOurs {
+				out.setCol(col, valo)
+			} else {
+				out.setCol(col, valt)
+			}
+		}
+	}
+	return out
+}
+
+// colChange returns the change of the column at _path from _old (when _inOld) to _new (when _inNew)
+func colChange(_path, _old string, _inOld bool, _new string, _inNew bool) Change {
+	switch {
+	case !_inOld:
+		return Change{Op: Added, Kind: KindColumn, Path: _path, New: _new}
+	case !_inNew:
+		return Change{Op: Removed, Kind: KindColumn, Path: _path, Old: _old}
+	}
+	return Change{Op: Changed, Kind: KindColumn, Path: _path, Old: _old, New: _new}
+}
+
+// removedChanged returns the conflict of a row or block removed by one side and changed by the other, ours when _changedByOurs
+func removedChanged(_kind, _path string, _changedByOurs bool) Conflict {
+	removed := Change{Op: Removed, Kind: _kind, Path: _path}
+	changed := Change{Op: Changed, Kind: _kind, Path: _path}
+	if _changedByOurs {
+		return Conflict{changed, removed}
+	}
+	return Conflict{removed, changed}
+}
+
+// isRowEqual reports whether two rows hold the same columns
+func isRowEqual(a, b *cfgRow) bool {
+	if len(a.cols) != len(b.cols) {
+		return false
+	}
+	for col, val := range a.cols {
+		if valb, ok := b.cols[col]; !ok || valb != val {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeNames returns the names of each list, in order, without repeats
+func mergeNames(_lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, list := range _lists {
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,103 @@
+package qcfg
+
+import (
+	"testing"
+)
+
+// To test Merge()
+func TestMerge(t *testing.T) {
+	load := func(text string) *CfgBlock {
+		cfg, err := LoadString("test.cfg", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	base := load(`
+%block app
+{
+    server :: host=alpha; port=80; tz=UTC;
+    client :: id=7;
+    cache  :: size=1;
+}
+%block old
+{
+    r :: x=1;
+}
+%block gone
+{
+    r :: x=1;
+}
+`)
+	ours := load(`
+%block app
+{
+    server :: host=beta; port=81; tz=UTC;
+    cache  :: size=2;
+    mine   :: a=1;
+}
+%block gone
+{
+    r :: x=2;
+}
+`)
+	theirs := load(`
+%block app
+{
+    server :: host=alpha; port=82; debug=1;
+    client :: id=7;
+    theirs :: b=1;
+}
+%block old
+{
+    r :: x=1;
+}
+%block added
+{
+    r :: y=1;
+}
+`)
+	merged, conflicts := Merge(base, ours, theirs)
+	want := []string{
+		`conflict in column app.server.port: ours "80" -> "81", theirs "80" -> "82"`,
+		`conflict in row app.cache: ours changed, theirs removed`,
+		`conflict in block gone: ours changed, theirs removed`,
+	}
+	if len(conflicts) != len(want) {
+		t.Fatalf("Expected %d conflicts, got %v", len(want), conflicts)
+	}
+	for ii, cc := range conflicts {
+		if cc.String() != want[ii] {
+			t.Errorf("Expected conflict %d to be %s, got %s", ii, want[ii], cc)
+		}
+	}
+
+	for _, tt := range []struct{ tbl, row, col, want string }{
+		{"app", "server", "host", "beta"}, // changed by ours only
+		{"app", "server", "port", "81"},   // conflict, ours kept
+		{"app", "server", "tz", ""},       // removed by theirs
+		{"app", "server", "debug", "1"},   // added by theirs
+		{"app", "cache", "size", "2"},     // changed by ours, removed by theirs
+		{"app", "mine", "a", "1"},
+		{"app", "theirs", "b", "1"},
+		{"added", "r", "y", "1"},
+		{"gone", "r", "x", "2"},
+	} {
+		if got := merged.Str(tt.tbl, tt.row, tt.col, ""); got != tt.want {
+			t.Errorf("Expected %s.%s.%s=%q, got %q", tt.tbl, tt.row, tt.col, tt.want, got)
+		}
+	}
+	if merged.RowExists("app", "client") {
+		t.Error("Expected app.client, removed by ours, to be removed")
+	}
+	if _, ok := merged.tbls["old"]; ok {
+		t.Error("Expected block old, removed by ours, to be removed")
+	}
+	if got := merged.GetRows("app"); len(got) != 4 || got[0] != "server" || got[3] != "theirs" {
+		t.Errorf("Expected the rows of ours then those added by theirs, got %v", got)
+	}
+
+	if _, conflicts := Merge(base, theirs, theirs); len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts when both sides agree, got %v", conflicts)
+	}
+}
@@ -4,7 +4,7 @@
 //
 // Candidates passed over include XML (human-unreadable), JSON (quote-burdened), Unix ini files (unhierarchical), Java properties files (unhierarchical), YAML (indentatious), eval'ed code (language specific).
 //
-// One could easily implement a diff program to highlight non-cosmetic changes (whitespace, comments and file/row/block reordering) to be used prior to checkin of config changes.
+// Diff (and "qcfg diff", see cmd/qcfg) highlights non-cosmetic changes, ignoring whitespace, comments and file/row/block reordering, to be used prior to checkin of config changes.
 //
 // The format is plain text with named blocks as the main construct.
 // Blocks contain named rows, and rows contained named columns.
@@ -17,6 +17,9 @@
 //
 // At any point, files may include other files using "%include /some/other/file".
 // This facilitates sharing common config between apps.
+// A relative include path is resolved against the directory of the including file, then against each directory of Loader.IncludePath.
+// The path may be a glob pattern ("%include conf.d/*.cfg") or a directory (whose *.cfg files are included), matched files are read in lexical order.
+// "%include_optional" (or "%include?") silently skips files that do not exist.
 //
 // While it should work otherwise, maintainability dictates you should
 //
@@ -28,37 +31,274 @@
 // Comments start at the Hash char (#) and extend to EOL.
 // Empty lines are ignored.
 // Block, row and column names are trimmed, so also column values.
+// A value may be double-quoted ("...") or single-quoted ('...') to keep blanks, ';', '=' or '#' as part of it,
+// with backslash escapes for \\, \", \', \n, \t and \r. Single-quoted values are taken literally, without ${...} substitution.
 //
 // Rows are defined by rowname on the left followed by "::" followed by list of column name=val pairs, each terminated by semi-colon.
 // Rows may be continued to the next line by the appearance of "+=" on the left of further column name-val pairs.
+// A block, or a row with "::", declared again within the same block replaces the earlier declaration.
+// "%duplicates merge" makes later declarations add to the earlier ones instead, "%duplicates error" makes them an error
+// (see DupPolicy and Loader.Duplicates), duplicates being reported to Loader.Warn with where each was declared.
+// "%unset block.row.col" removes a column read so far, "%delete block.row" a row (or "%delete block" a block), e.g. from a base config
+// included above. Paths are as in ${block.row.col} and several may follow the directive. Removing what is not there is an error.
 //
-// Env-variable substitution is not yet implemented.
+// "%block dev %extends base" gives dev every row, column and nested block of base that it does not define itself.
+// The parent is a block declared alongside, or given by its dotted path from the top level (e.g. "envs.base"), wherever it is declared.
+// Inheritance is resolved once all files are loaded, before cross-references, so that chains of %extends work and cycles are reported.
+//
+// A row may take the columns it does not set from a row declared before it in the same block, its template, with the %from column:
+// "job2 :: %from=job; region=EMEA;". The %from column itself is not kept.
+//
+// A multi-line value is written as a heredoc: "query = <<EOT" ends the row line, the following lines are taken verbatim as the value,
+// up to a line starting with EOT (any name made of letters, digits and _ will do), after which the row carries on, e.g. "EOT; user=foo;".
+// The value does not include the line break before EOT. With <<'EOT' the value is taken literally, without ${...} substitution.
+//
+// Env-variables are substituted into column values and %include paths at load time, using the shell forms
+// ${VAR}, ${VAR:-default} (used when VAR is unset or empty) and ${VAR:?message} (a load error when VAR is unset or empty).
+// See Loader.NoEnv and Loader.LookupEnv to disable the substitution or supply the variables.
+// "%define region=NAM tz=US/Eastern" sets variables, taken before the environment, for the rest of its file and the files it includes.
+// So do name=value parameters after an included file, "%include region.cfg region=NAM", for that file only, and Loader.Vars for the whole load,
+// so that the same snippet can be included with different names. A parameter value may be double-quoted to hold blanks.
+// Variables are substituted in the names of blocks and rows as well, e.g. "%block feed_${region}", a name left holding "${" being an error.
+//
+// Lines between "%if env == prod" (or "%if env != \"prod\"", "%if NAME", "%if !NAME") and "%else" or "%endif" are only read when the condition holds,
+// those between "%else" and "%endif" when it does not. The variables are those of ${NAME}, "hostname" giving the name of the host when not set.
+// A double-quoted value may hold blanks and #. Sections may nest but must end within the file they start in.
+//
+// A value may refer to another cell with ${block.row.col} (${row.col} for a top-level row, ${block.nested.row.col} within nested blocks),
+// also with the :- and :? forms. References are resolved once all files are loaded, reporting dangling references and cycles as errors.
+//
+// A loaded config keeps the text of its files as read, so that a value changed with EditEntry can be written back with WriteSource
+// leaving comments, blank lines, %include directives and the layout of every other row untouched.
+// SaveAll writes each edit back into the file, top-level or included, that it was read from.
+// Update makes the same kind of edits for the content of another config, e.g. the result of Merge, removing the lines of what it lacks.
+//
+// Format, also run by "qcfg fmt" (see cmd/qcfg), lays out config text canonically, keeping its comments.
+//
+// Layers stacks configs, e.g. base, region and host overrides, looking each cell up in the highest layer that defines it.
 package qcfg
 
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
 type cfgRow struct {
-	name string
-	cols map[string]string
+	name     string
+	cols     map[string]string
+	colOrder []string // names of cols, in declaration order
+	syn      *cstRow  // where the row was read from, nil when not read from a file
 }
 
 // CfgBlock struct holds the in-memory representation of a top-level config file
 type CfgBlock struct {
-	name  string                 // block name
-	fname string                 // file containing the block
-	rows  map[string](*cfgRow)   // non-recursive
-	tbls  map[string](*CfgBlock) // recursive
+	name     string                 // block name
+	fname    string                 // file containing the block
+	rows     map[string](*cfgRow)   // non-recursive
+	tbls     map[string](*CfgBlock) // recursive
+	rowOrder []string               // names of rows, in declaration order
+	tblOrder []string               // names of tbls, in declaration order
+	syn      *cstBlock              // where the block was read from, nil when not read from a file
+}
+
+// Errors reported (wrapped in a *ParseError) for problems found while loading a config file
+var (
+	ErrMalformedRow        = errors.New("malformed row")
+	ErrUnterminatedBlock   = errors.New("unterminated block")
+	ErrUnmatchedBlockEnd   = errors.New("unmatched }")
+	ErrIncludeDepth        = errors.New("%include nested too deeply")
+	ErrUnterminatedQuote   = errors.New("unterminated quoted value")
+	ErrUnterminatedHeredoc = errors.New("unterminated heredoc value")
+	ErrBadDirective        = errors.New("malformed directive")
+	ErrUnknownBlock        = errors.New("%extends unknown block")
+	ErrExtendsCycle        = errors.New("%extends cycle")
+	ErrUnknownRow          = errors.New("%from unknown row")
+	ErrUnmatchedCond       = errors.New("%else or %endif without %if")
+	ErrUnterminatedCond    = errors.New("%if without %endif")
+	ErrMissingElement      = errors.New("%unset or %delete of a missing element")
+	ErrNotAllowed          = errors.New("not allowed by Loader.Raw or Loader.NoConditions")
+)
+
+// IncludeCycleError reports a file that includes itself, directly or through other files
+type IncludeCycleError struct {
+	Files []string // the chain of included files, starting and ending with the repeated one
+}
+
+func (e *IncludeCycleError) Error() string {
+	return "%include cycle: " + strings.Join(e.Files, " -> ")
+}
+
+// DupPolicy tells what a load does when a block, or a row with "::", is declared again within the same block.
+// Loader.Duplicates sets it for a load, "%duplicates replace", "%duplicates merge" or "%duplicates error" for the rest
+// of the file holding the directive and the files it then includes
+type DupPolicy int
+
+// The DupPolicy values
+const (
+	DupReplace DupPolicy = iota // the later declaration replaces the earlier one
+	DupMerge                    // the later declaration adds to the earlier one, its columns replacing those of the same name
+	DupError                    // a later declaration is a load error, and replaces the earlier one
+)
+
+// dupPolicies maps the argument of "%duplicates" to its DupPolicy
+var dupPolicies = map[string]DupPolicy{"replace": DupReplace, "merge": DupMerge, "error": DupError}
+
+// DuplicateError reports a block or row declared more than once.
+// Under DupError it is a load error, otherwise a warning passed to Loader.Warn
+type DuplicateError struct {
+	Kind string   // KindBlock or KindRow
+	Path string   // dotted path of the block or row
+	Defs []string // "file:line" of each declaration, in the order read
+}
+
+func (e *DuplicateError) Error() string {
+	return "duplicate " + e.Kind + " " + e.Path + " declared at " + strings.Join(e.Defs, ", ")
+}
+
+// ParseError records a problem found while loading a config file.
+// Err is one of the Err* values, or the error returned when opening an included file
+type ParseError struct {
+	Fname string   // file being read
+	Line  int      // 1-based line number within Fname
+	Col   int      // 1-based column of the offending text within the line
+	Text  string   // the offending line, trimmed of blanks and comments
+	Chain []string // "file:line" of each %include that led to Fname, outermost first
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	msg := fmt.Sprintf("%s:%d:%d: %v: %s", e.Fname, e.Line, e.Col, e.Err, e.Text)
+	if len(e.Chain) > 0 {
+		msg += " (included from " + strings.Join(e.Chain, " -> ") + ")"
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is and errors.As to inspect the underlying error
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ErrorList holds every problem found by a single load, in the order they were found
+type ErrorList []*ParseError
+
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for ii, e := range el {
+		msgs[ii] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap allows errors.Is and errors.As to inspect each of the errors in the list
+func (el ErrorList) Unwrap() []error {
+	errs := make([]error, len(el))
+	for ii, e := range el {
+		errs[ii] = e
+	}
+	return errs
 }
 
 var cfgs = make(map[string]*CfgBlock) // The set of top-level configs initialized within the program
 
+func newCfgBlock(_name, _fname string) *CfgBlock {
+	return &CfgBlock{_name, _fname, make(map[string](*cfgRow), 1), make(map[string](*CfgBlock), 1), nil, nil, nil}
+}
+
+func newCfgRow(_name string) *cfgRow {
+	return &cfgRow{_name, make(map[string]string, 1), nil, nil}
+}
+
+// setRow adds row to cfg, replacing any row of the same name but keeping its place in the declaration order
+func (cfg *CfgBlock) setRow(row *cfgRow) {
+	if _, ok := cfg.rows[row.name]; !ok {
+		cfg.rowOrder = append(cfg.rowOrder, row.name)
+	}
+	cfg.rows[row.name] = row
+}
+
+// setBlock adds the nested block _tbl to cfg, replacing any block of the same name but keeping its place in the declaration order
+func (cfg *CfgBlock) setBlock(_name string, _tbl *CfgBlock) {
+	if _, ok := cfg.tbls[_name]; !ok {
+		cfg.tblOrder = append(cfg.tblOrder, _name)
+	}
+	cfg.tbls[_name] = _tbl
+}
+
+// setCol sets a column of row, keeping the declaration order
+func (row *cfgRow) setCol(_name, _val string) {
+	if _, ok := row.cols[_name]; !ok {
+		row.colOrder = append(row.colOrder, _name)
+	}
+	row.cols[_name] = _val
+}
+
+// delRow removes the row _name from cfg and from the declaration order
+func (cfg *CfgBlock) delRow(_name string) {
+	delete(cfg.rows, _name)
+	cfg.rowOrder = removeName(cfg.rowOrder, _name)
+	if cfg.syn != nil {
+		cfg.syn.remove(KindRow, _name)
+	}
+}
+
+// delBlock removes the nested block _name from cfg and from the declaration order
+func (cfg *CfgBlock) delBlock(_name string) {
+	delete(cfg.tbls, _name)
+	cfg.tblOrder = removeName(cfg.tblOrder, _name)
+	if cfg.syn != nil {
+		cfg.syn.remove(KindBlock, _name)
+	}
+}
+
+// delCol removes a column of row and from the declaration order
+func (row *cfgRow) delCol(_name string) {
+	delete(row.cols, _name)
+	row.colOrder = removeName(row.colOrder, _name)
+	if row.syn != nil {
+		row.syn.remove(_name)
+	}
+}
+
+// removeName returns _names without _name
+func removeName(_names []string, _name string) []string {
+	for ii, name := range _names {
+		if name == _name {
+			return append(_names[:ii:ii], _names[ii+1:]...)
+		}
+	}
+	return _names
+}
+
+// clone returns a copy of row, not tied to any source
+func (row *cfgRow) clone() *cfgRow {
+	row2 := newCfgRow(row.name)
+	for _, col := range row.colOrder {
+		row2.setCol(col, row.cols[col])
+	}
+	return row2
+}
+
+// clone returns a deep copy of cfg, not tied to any source
+func (cfg *CfgBlock) clone() *CfgBlock {
+	cfg2 := newCfgBlock(cfg.name, cfg.fname)
+	for _, name := range cfg.rowOrder {
+		cfg2.setRow(cfg.rows[name].clone())
+	}
+	for _, name := range cfg.tblOrder {
+		cfg2.setBlock(name, cfg.tbls[name].clone())
+	}
+	return cfg2
+}
+
 func cleanLine(_line *[]byte) {
 	// remove leading and trailing blanks
 	nn := bytes.Index(*_line, []byte("#"))
@@ -70,18 +310,109 @@ func cleanLine(_line *[]byte) {
 	*_line = line
 }
 
-func getFilename(_line []byte) []byte {
+// stripComment returns _line without its comment, a '#' within double quotes being kept, and without leading and trailing blanks
+func stripComment(_line []byte) []byte {
+	quoted := false
+	for ii, cc := range _line {
+		if cc == '"' {
+			quoted = !quoted
+		} else if cc == '#' && !quoted {
+			_line = _line[:ii]
+			break
+		}
+	}
+	return bytes.Trim(_line, " \t")
+}
+
+// getFilename returns the file named by an include line, the name=value parameters that follow it,
+// and whether it was "%include_optional" or "%include?"
+func getFilename(_line []byte) ([]byte, []byte, bool) {
 	parts := bytes.SplitN(_line, []byte(" "), 2)
 	if len(parts) > 1 {
-		if bytes.Equal([]byte("%include"), bytes.ToLower(parts[0])) {
+		directive := string(bytes.ToLower(parts[0]))
+		if directive == "%include" || directive == "%include_optional" || directive == "%include?" {
 			cleanLine(&parts[1])
-			if parts[1][0] == '"' {
-				return parts[1][1 : len(parts[1])-1]
+			fname, params := parts[1], []byte(nil)
+			words, starts := splitWords(fname)
+			nn := len(words)
+			for nn > 1 && isParam(words[nn-1]) {
+				nn--
 			}
-			return parts[1]
+			if nn < len(words) {
+				fname, params = bytes.TrimRight(fname[:starts[nn]], " \t"), fname[starts[nn]:]
+			}
+			if len(fname) > 1 && fname[0] == '"' {
+				fname = fname[1 : len(fname)-1]
+			}
+			return fname, params, directive != "%include"
 		}
 	}
-	return nil
+	return nil, nil, false
+}
+
+// splitWords splits _text at runs of blanks, except within double quotes, returning each word and its offset within _text
+func splitWords(_text []byte) ([][]byte, []int) {
+	var words [][]byte
+	var starts []int
+	start, quoted := -1, false
+	for ii := 0; ii <= len(_text); ii++ {
+		if ii == len(_text) || !quoted && (_text[ii] == ' ' || _text[ii] == '\t') {
+			if start >= 0 {
+				words, starts = append(words, _text[start:ii]), append(starts, start)
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = ii
+		}
+		if _text[ii] == '"' {
+			quoted = !quoted
+		}
+	}
+	return words, starts
+}
+
+// isParam reports whether _word is a name=value parameter
+func isParam(_word []byte) bool {
+	nn := bytes.IndexByte(_word, '=')
+	return nn > 0 && isVarName(string(_word[:nn]))
+}
+
+// isVarName reports whether _name may be set by %define or an include parameter: letters, digits and _
+func isVarName(_name string) bool {
+	for _, cc := range _name {
+		if !(cc == '_' || cc >= '0' && cc <= '9' || cc >= 'a' && cc <= 'z' || cc >= 'A' && cc <= 'Z') {
+			return false
+		}
+	}
+	return _name != ""
+}
+
+// parseParams returns the variables set by the name=value words of _text, as found after "%define" or an included file name.
+// A value may be double-quoted to hold blanks. The values are expanded with _expand
+func parseParams(_text []byte, _expand func(string) (string, error)) (map[string]string, error) {
+	vars := make(map[string]string)
+	words, _ := splitWords(_text)
+	for _, word := range words {
+		if !isParam(word) {
+			return nil, ErrBadDirective
+		}
+		nn := bytes.IndexByte(word, '=')
+		val := word[nn+1:]
+		if len(val) > 0 && val[0] == '"' {
+			if len(val) < 2 || val[len(val)-1] != '"' {
+				return nil, ErrUnterminatedQuote
+			}
+			val = val[1 : len(val)-1]
+		}
+		exp, err := _expand(string(val))
+		if err != nil {
+			return nil, err
+		}
+		vars[string(word[:nn])] = exp
+	}
+	return vars, nil
 }
 
 func lineIsInclude(_line []byte) bool {
@@ -91,6 +422,12 @@ func lineIsInclude(_line []byte) bool {
 	return false
 }
 
+// lineIsDirective reports whether _line is the directive _name (e.g. "%duplicates"), followed by blanks or the end of line
+func lineIsDirective(_line []byte, _name string) bool {
+	return len(_line) >= len(_name) && strings.EqualFold(string(_line[:len(_name)]), _name) &&
+		(len(_line) == len(_name) || _line[len(_name)] == ' ' || _line[len(_name)] == '\t')
+}
+
 func lineIsBlockEnd(_line []byte) bool {
 	if (len(_line) > 0) && (_line[0] == '}') {
 		return true
@@ -108,201 +445,1059 @@ func lineIsBlockNew(_line []byte) bool {
 	return false
 }
 
-// Block xxx
-func getBlockname(_line []byte) []byte {
+// Block xxx, or Block xxx %extends yyy, in which case yyy is also returned
+func getBlockname(_line []byte) ([]byte, []byte) {
 	parts := bytes.SplitN(_line, []byte(" "), 2)
 	if len(parts) > 1 {
 		if bytes.Equal([]byte("%block"), bytes.ToLower(parts[0])) {
 			cleanLine(&parts[1])
-			return parts[1]
+			if nn := bytes.Index(bytes.ToLower(parts[1]), []byte(" %extends ")); nn >= 0 {
+				parent := parts[1][nn+len(" %extends "):]
+				cleanLine(&parent)
+				name := parts[1][:nn]
+				cleanLine(&name)
+				return name, parent
+			}
+			return parts[1], nil
 		}
 	}
 	fmt.Printf("getBlockname: line(%s) is not block\n", string(_line))
-	return []byte("") // Should never be called such that it would reach here
+	return []byte(""), nil // Should never be called such that it would reach here
 }
 
-func (cfg CfgBlock) loadRow(_line []byte, _fname string, _rowName []byte) []byte {
-	cleanLine(&_line)
+// loadRow adds the columns of the row line last read from src to cfg, the line being extended by the lines of any heredoc value.
+// _rowName is that of the row being continued by a "+=" line, or nil for a new row.
+// Values left holding cross-references are recorded, to be resolved by finish
+func (p *parser) loadRow(cfg *CfgBlock, src *cfgSource, _rowName []byte) ([]byte, error) {
+	line, lineNo := src.cur(), src.line
+	lead := len(line.text) - len(bytes.TrimLeft(line.text, " \t"))
+	head := bytes.TrimRight(line.text[lead:], "\r\n") // the row name is looked for ignoring comments, values are scanned by scanCols
+	cleanLine(&head)
 
 	add := false
 
-	var rowData []byte
+	var start int
+	var nameErr error
 	if len(_rowName) < 1 {
-		nnNew := bytes.Index(_line, []byte("::"))
-		nnAdd := bytes.Index(_line, []byte("+="))
-		if (nnNew >= 0) && (nnAdd > 0) {
-			if nnNew > nnAdd {
-				_rowName = _line[:nnAdd]
-				rowData = _line[nnAdd+2:]
-			} else {
-				_rowName = _line[:nnNew]
-				rowData = _line[nnNew+2:]
-				add = true
-			}
-		} else if nnAdd > 0 {
-			_rowName = _line[:nnAdd]
-			rowData = _line[nnAdd+2:]
-			add = true
-		} else if nnNew > 0 {
-			_rowName = _line[:nnNew]
-			rowData = _line[nnNew+2:]
-		} else {
-			fmt.Printf("loadRow: could not understand cleaned line (%s)\n", string(_line))
-			return nil
+		if start, add = splitRow(head); start < 0 {
+			return nil, ErrMalformedRow
 		}
+		_rowName = head[:start]
 		cleanLine(&_rowName)
-		cleanLine(&rowData)
+		if name, err := p.expandName(string(_rowName), src); err != nil {
+			nameErr = err
+		} else {
+			_rowName = []byte(name)
+		}
 	} else {
 		add = true
-		rowData = _line
 	}
+	start += lead + 2
 
 	row, ok := cfg.rows[(string)(_rowName)]
-	if (ok && !add) || (!ok) {
-		cfg.rows[(string)(_rowName)] = &cfgRow{string(_rowName), make(map[string]string, 1)}
-		row, ok = cfg.rows[(string)(_rowName)]
-		if !ok {
-			fmt.Printf("loadRow:  rowName(%s) not found in rows, added, still not found\n", string(_rowName))
+	if !add || !ok {
+		if dup := p.declare(KindRow, p.paths[cfg]+string(_rowName), src); dup != nil && src.dup == DupError {
+			p.errorAt(src, lineNo, lead+1, head, dup)
 		}
 	}
+	if (ok && !add && src.dup != DupMerge) || (!ok) {
+		row = newCfgRow(string(_rowName))
+		row.syn = &cstRow{first: line}
+		cfg.setRow(row)
+	}
 
-	cols := bytes.Split(rowData, []byte(";"))
+	cols, text, err := scanCols(line.text, start, src.readRaw)
+	line.text = text
+	if err != nil {
+		return _rowName, err
+	}
+	if row.syn != nil {
+		row.syn.file, row.syn.last = src.file, line
+	}
 
-	var kvarr [][]byte
-	for str := range cols {
-		kvarr = bytes.SplitN(cols[str], []byte("="), 2)
-		cleanLine(&kvarr[0])
-		if len(kvarr[0]) < 1 {
+	firstErr := nameErr
+	var tmpl *cfgRow
+	for _, cc := range cols {
+		if cc.name == "%from" && p.ld.Raw {
+			if firstErr == nil {
+				firstErr = ErrNotAllowed
+			}
 			continue
 		}
-		if len(kvarr) < 2 {
+		if cc.name == "%from" {
+			name, err := p.expandName(cc.value, src)
+			if err == nil && cfg.rows[name] == nil {
+				err = ErrUnknownRow
+			}
+			if tmpl = cfg.rows[name]; err != nil && firstErr == nil {
+				firstErr = err
+			}
 			continue
 		}
-		cleanLine(&kvarr[1])
-		row.cols[(string)(kvarr[0])] = (string)(kvarr[1])
+		val := cc.value
+		p.dropRef(cellKey{cfg, row.name, cc.name}) // a value declared again no longer holds the earlier references
+		if p.ld.Raw {
+			if cc.literal && strings.Contains(val, "${") && firstErr == nil {
+				firstErr = ErrNotAllowed // it could not be told apart from ${...} to be substituted, see WriteOptions.Raw
+			}
+		} else if !cc.literal {
+			if val, err = p.ld.expand(val, src.vars); err != nil && firstErr == nil {
+				firstErr = err
+			} else if err == nil && strings.Contains(val, "${") {
+				pos := ParseError{src.fname, lineNo, cc.from + 1, cc.value, src.chain(), nil}
+				p.addRef(&pendingRef{key: cellKey{cfg, row.name, cc.name}, pos: pos})
+			}
+		}
+		row.setCol(cc.name, val)
+		if row.syn != nil {
+			row.syn.setCell(cc.name, line.addCell(src.file, cc.from, cc.to))
+		}
+	}
+	if tmpl != nil && tmpl != row {
+		p.fillRow(cfg, row, tmpl)
 	}
-	return _rowName
+	return _rowName, firstErr
 }
 
-// Recursive call to read a Block
-func (cfg CfgBlock) loadBlock(_rdr *bufio.Reader, _fname string, _tblname string, _verbose bool) {
-	done := false
-	var prevRow []byte
-	for done == false {
-		buf, err := _rdr.ReadBytes('\n')
-		if err != nil {
-			done = true
+// fillRow gives row, of block cfg, the columns of the template row _tmpl that it does not have, those of _tmpl coming first.
+// Copied values holding cross-references are resolved as the originals
+func (p *parser) fillRow(cfg *CfgBlock, row, _tmpl *cfgRow) {
+	for _, col := range _tmpl.colOrder {
+		if _, ok := row.cols[col]; ok {
+			continue
 		}
-		if len(buf) < 1 {
+		row.cols[col] = _tmpl.cols[col]
+		if pr := p.pending[cellKey{cfg, _tmpl.name, col}]; pr != nil {
+			p.addRef(&pendingRef{key: cellKey{cfg, row.name, col}, pos: pr.pos})
+		}
+	}
+	row.colOrder = mergeNames(_tmpl.colOrder, row.colOrder)
+}
+
+// splitRow returns the index of the "::" or "+=" that ends the row name within _head, a row line without its comment, or -1.
+// It also tells whether the columns are added to an existing row of that name rather than replacing it
+func splitRow(_head []byte) (int, bool) {
+	nnNew := bytes.Index(_head, []byte("::"))
+	nnAdd := bytes.Index(_head, []byte("+="))
+	if (nnNew >= 0) && (nnAdd > 0) {
+		if nnNew > nnAdd {
+			return nnAdd, false
+		}
+		return nnNew, true
+	} else if nnAdd > 0 {
+		return nnAdd, true
+	} else if nnNew > 0 {
+		return nnNew, false
+	}
+	return -1, false
+}
+
+// rowStart returns the offset of the columns within the row line _text, after its "::" or "+=", or -1 when it is no row line
+func rowStart(_text []byte) int {
+	lead := len(_text) - len(bytes.TrimLeft(_text, " \t"))
+	head := bytes.TrimRight(_text[lead:], "\r\n")
+	cleanLine(&head)
+	if bytes.HasPrefix(head, []byte("+=")) {
+		return lead + 2
+	}
+	if nn, _ := splitRow(head); nn >= 0 {
+		return lead + nn + 2
+	}
+	return -1
+}
+
+// colToken is a name=value column scanned from a row line
+type colToken struct {
+	name     string
+	value    string // unquoted and unescaped
+	literal  bool   // the value was single-quoted, so is not subject to ${...} substitution
+	from, to int    // the source text of the value (quotes and heredoc included) within the scanned line
+}
+
+// scanCols splits the columns part of the row line _text, from offset _start, into its name=value columns, up to any comment.
+// A value may be "double" or 'single' quoted, with backslash escapes, to hold blanks, ';', '#' or quotes.
+// A heredoc value (<<TAG or <<'TAG') is made of the lines read from _next up to one starting with TAG,
+// scanning then carries on after the TAG. Those lines are appended to _text, which is returned.
+// Columns without a name or an "=" are ignored
+func scanCols(_text []byte, _start int, _next func() ([]byte, bool)) ([]colToken, []byte, error) {
+	var cols []colToken
+	atEOL := func(ii int) bool {
+		return ii >= len(_text) || _text[ii] == '\n' || _text[ii] == '\r'
+	}
+	ii := _start
+	for !atEOL(ii) {
+		switch _text[ii] {
+		case ' ', '\t', ';':
+			ii++
 			continue
+		case '#':
+			return cols, _text, nil
 		}
-		buf = buf[:len(buf)-1]
-		cleanLine(&buf)
-		if len(buf) < 1 {
+		start := ii
+		for !atEOL(ii) && _text[ii] != '=' && _text[ii] != ';' && _text[ii] != '#' {
+			ii++
+		}
+		if atEOL(ii) || _text[ii] != '=' {
 			continue
 		}
-		if false {
-		} else if lineIsInclude(buf) {
-			// recursive call, which assumes there was no partially unconsumed line
-			fname2 := expandUser(string(getFilename(bytes.TrimSpace(buf))))
-			fpNew, err := os.Open(fname2)
+		col := colToken{name: string(bytes.Trim(_text[start:ii], " \t"))}
+		ii++
+		for !atEOL(ii) && (_text[ii] == ' ' || _text[ii] == '\t') {
+			ii++
+		}
+		col.from = ii
+		if tag, literal, nn := heredocTag(_text[ii:]); tag != nil {
+			for ii += nn; !atEOL(ii) && (_text[ii] == ' ' || _text[ii] == '\t'); ii++ {
+			}
+			if !atEOL(ii) && _text[ii] != '#' {
+				return nil, _text, ErrMalformedRow
+			}
+			var lines []string
+			for {
+				line, ok := _next()
+				if !ok {
+					return nil, _text, ErrUnterminatedHeredoc
+				}
+				at := len(_text)
+				_text = append(_text, line...)
+				line = bytes.TrimRight(line, "\r\n")
+				trimmed := bytes.TrimLeft(line, " \t")
+				if bytes.HasPrefix(trimmed, tag) && (len(trimmed) == len(tag) || bytes.IndexByte([]byte("; \t#"), trimmed[len(tag)]) >= 0) {
+					ii = at + len(line) - len(trimmed) + len(tag)
+					break
+				}
+				lines = append(lines, string(line))
+			}
+			col.value, col.literal, col.to = strings.Join(lines, "\n"), literal, ii
+		} else if !atEOL(ii) && (_text[ii] == '"' || _text[ii] == '\'') {
+			val, nn, err := unquote(_text[ii:])
 			if err != nil {
-				panic("could not open file " + fname2)
+				return nil, _text, err
+			}
+			col.value, col.literal = val, _text[ii] == '\''
+			ii += nn
+			col.to = ii
+			for !atEOL(ii) && (_text[ii] == ' ' || _text[ii] == '\t') {
+				ii++
+			}
+			if !atEOL(ii) && _text[ii] != ';' && _text[ii] != '#' {
+				return nil, _text, ErrMalformedRow
 			}
-			rdrNew := bufio.NewReader(fpNew)
-			cfg.loadCfgFile(fname2, rdrNew, _verbose)
-			fpNew.Close()
-		} else if lineIsBlockEnd(buf) {
-			// processBlock, which assumes there was no partially unconsumed line
-			return
-		} else if lineIsBlockNew(buf) {
-			// processBlock, which assumes there was no partially unconsumed line
-			name2 := string(getBlockname(buf))
-			cfg.tbls[name2] = &CfgBlock{name2, _fname, make(map[string](*cfgRow), 1), make(map[string](*CfgBlock), 1)}
-			cfg.tbls[name2].loadBlock(_rdr, _fname, name2, _verbose)
-		} else if (len(buf) > 2) && (buf[0] == '+') && (buf[1] == '=') {
-			prevRow = cfg.loadRow(buf[2:], _fname, prevRow)
-		} else if (len(buf) > 0) && (buf[0] == '{') {
 		} else {
-			prevRow = cfg.loadRow(buf, _fname, nil)
+			for !atEOL(ii) && _text[ii] != ';' && _text[ii] != '#' {
+				ii++
+			}
+			val := bytes.TrimRight(_text[col.from:ii], " \t")
+			col.value, col.to = string(val), col.from+len(val)
+		}
+		if len(col.name) > 0 {
+			cols = append(cols, col)
+		}
+	}
+	return cols, _text, nil
+}
+
+// heredocTag returns the TAG of a heredoc value starting at _data, whether it was quoted (<<'TAG') and the number of bytes it spans.
+// The TAG is nil when _data does not start a heredoc
+func heredocTag(_data []byte) ([]byte, bool, int) {
+	if !bytes.HasPrefix(_data, []byte("<<")) {
+		return nil, false, 0
+	}
+	ii, literal := 2, false
+	if ii < len(_data) && _data[ii] == '\'' {
+		ii, literal = 3, true
+	}
+	start := ii
+	for ii < len(_data) && (_data[ii] == '_' || ('0' <= _data[ii] && _data[ii] <= '9') ||
+		('a' <= _data[ii] && _data[ii] <= 'z') || ('A' <= _data[ii] && _data[ii] <= 'Z')) {
+		ii++
+	}
+	tag := _data[start:ii]
+	if len(tag) < 1 {
+		return nil, false, 0
+	}
+	if literal {
+		if ii >= len(_data) || _data[ii] != '\'' {
+			return nil, false, 0
+		}
+		ii++
+	}
+	return tag, literal, ii
+}
+
+// heredoc returns the multi-line _val written as a heredoc, with a TAG that none of its lines start with
+func heredoc(_val string, _raw bool) string {
+	tag := "EOT"
+	for ii := 1; ; ii++ {
+		clash := false
+		for _, line := range strings.Split(_val, "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, " \t"), tag) {
+				clash = true
+				break
+			}
+		}
+		if !clash {
+			break
+		}
+		tag = fmt.Sprintf("EOT%d", ii)
+	}
+	if strings.Contains(_val, "${") && !_raw {
+		return "<<'" + tag + "'\n" + _val + "\n" + tag
+	}
+	return "<<" + tag + "\n" + _val + "\n" + tag
+}
+
+// unquote returns the value of the quoted string at the start of _data, and the number of bytes it spans
+func unquote(_data []byte) (string, int, error) {
+	var val []byte
+	quote := _data[0]
+	for ii := 1; ii < len(_data); ii++ {
+		switch cc := _data[ii]; {
+		case cc == quote:
+			return string(val), ii + 1, nil
+		case cc == '\n' || cc == '\r':
+			return "", ii, ErrUnterminatedQuote
+		case cc == '\\' && ii+1 < len(_data):
+			ii++
+			switch _data[ii] {
+			case 'n':
+				val = append(val, '\n')
+			case 't':
+				val = append(val, '\t')
+			case 'r':
+				val = append(val, '\r')
+			case '\\', '"', '\'':
+				val = append(val, _data[ii])
+			default:
+				val = append(val, '\\', _data[ii])
+			}
+		default:
+			val = append(val, cc)
+		}
+	}
+	return "", len(_data), ErrUnterminatedQuote
+}
+
+// quoteValue returns _val as it is to be written to a config file, quoted and escaped when it would not read back as is.
+// Multi-line values are written as a heredoc. Single quotes are used for a value holding "${", so that it is not substituted when read,
+// unless _raw, for a value read by Loader.Raw whose ${...} is still to be substituted
+func quoteValue(_val string, _raw bool) string {
+	literal := strings.Contains(_val, "${") && !_raw
+	if strings.Contains(_val, "\n") && !strings.Contains(_val, "\r") {
+		return heredoc(_val, _raw)
+	}
+	if _val == strings.Trim(_val, " \t") && !strings.ContainsAny(_val, ";#\n\r") && !literal &&
+		!strings.HasPrefix(_val, "\"") && !strings.HasPrefix(_val, "'") && !strings.HasPrefix(_val, "<<") {
+		return _val
+	}
+	quote := byte('"')
+	if literal {
+		quote = '\''
+	}
+	out := []byte{quote}
+	for ii := 0; ii < len(_val); ii++ {
+		switch cc := _val[ii]; cc {
+		case '\\', quote:
+			out = append(out, '\\', cc)
+		case '\n':
+			out = append(out, '\\', 'n')
+		case '\r':
+			out = append(out, '\\', 'r')
+		default:
+			out = append(out, cc)
+		}
+	}
+	return string(append(out, quote))
+}
+
+// cfgSource tracks the reading position within one file of a load
+type cfgSource struct {
+	fname  string
+	key    string // fname made absolute, to recognise the file when it is included again
+	rdr    *bufio.Reader
+	line   int               // number of the line last read, 1-based
+	depth  int               // number of %includes that led here
+	parent *cfgSource        // the file whose %include led here, nil for the top-level file
+	file   *cstFile          // the lines read so far
+	dup    DupPolicy         // for blocks and rows declared again, set by %duplicates
+	vars   map[string]string // substituted as ${NAME}, from Loader.Vars, the parameters of the %include and %define
+	conds  []*condFrame      // the %if sections open
+}
+
+// readLine records the next line in src.file and returns it without its line terminator, or false at EOF
+func (src *cfgSource) readLine() ([]byte, bool) {
+	buf, ok := src.readRaw()
+	if !ok {
+		return nil, false
+	}
+	src.file.lines = append(src.file.lines, &cstLine{text: buf})
+	return bytes.TrimRight(buf, "\r\n"), true
+}
+
+// readRaw returns the next line with its line terminator, or false at EOF
+func (src *cfgSource) readRaw() ([]byte, bool) {
+	buf, err := src.rdr.ReadBytes('\n')
+	if err != nil && len(buf) < 1 {
+		return nil, false
+	}
+	src.line++
+	return buf, true
+}
+
+// cur returns the line last recorded by readLine
+func (src *cfgSource) cur() *cstLine {
+	return src.file.lines[len(src.file.lines)-1]
+}
+
+// chain lists the %include lines that led to src, outermost first
+func (src *cfgSource) chain() []string {
+	var chain []string
+	for pp := src.parent; pp != nil; pp = pp.parent {
+		chain = append([]string{fmt.Sprintf("%s:%d", pp.fname, pp.line)}, chain...)
+	}
+	return chain
+}
+
+// parser holds the state of a single Load
+type parser struct {
+	ld      *Loader
+	errs    ErrorList
+	refs    []*pendingRef           // cells holding cross-references
+	pending map[cellKey]*pendingRef // the reference recorded last for each cell, until the cell is declared again
+	doc     *cstDoc                 // the lines of every file read
+	paths   map[*CfgBlock]string    // dotted path of each block below the top-level one, ending with "."
+	decls   map[string]*declaration // by kind and path of the block or row
+	dups    []*declaration          // the declarations that were repeated, in the order found
+	extends []*extension            // blocks declared with %extends
+	root    *CfgBlock               // the top-level block, from which %unset and %delete paths start
+}
+
+// declaration records where a block or row was declared
+type declaration struct {
+	kind, path string
+	defs       []string
+	warn       bool // repeated other than under DupError
+}
+
+// declare records that the block or row at _path is declared at the current line of src.
+// When it was declared before it returns the problem, which is also recorded to be passed to Loader.Warn unless the policy is DupError
+func (p *parser) declare(_kind, _path string, src *cfgSource) *DuplicateError {
+	if p.decls == nil {
+		p.decls = make(map[string]*declaration)
+	}
+	decl, ok := p.decls[_kind+" "+_path]
+	if !ok {
+		decl = &declaration{kind: _kind, path: _path}
+		p.decls[_kind+" "+_path] = decl
+	}
+	decl.defs = append(decl.defs, fmt.Sprintf("%s:%d", src.fname, src.line))
+	if len(decl.defs) < 2 {
+		return nil
+	}
+	if len(decl.defs) == 2 {
+		p.dups = append(p.dups, decl)
+	}
+	decl.warn = decl.warn || src.dup != DupError
+	if _kind == KindBlock && src.dup != DupMerge {
+		// what the replaced block held is no longer declared
+		for key, dd := range p.decls {
+			if strings.HasPrefix(dd.path, _path+".") {
+				delete(p.decls, key)
+			}
+		}
+	}
+	return &DuplicateError{_kind, _path, append([]string{}, decl.defs...)}
+}
+
+// expandName substitutes the variables of src, such as include parameters, in the name of a block or row, or a path of them.
+// A name left holding "${" is reported as ErrBadDirective and returned as written, as is any name with Loader.Raw
+func (p *parser) expandName(_name string, src *cfgSource) (string, error) {
+	if p.ld.Raw {
+		return _name, nil
+	}
+	name, err := p.ld.expand(_name, src.vars)
+	if err == nil && strings.Contains(name, "${") {
+		err = ErrBadDirective
+	}
+	if err != nil {
+		return _name, err
+	}
+	return name, nil
+}
+
+// remove applies "%unset _path", a column given as block.row.col (row.col for a top-level row) when _col,
+// otherwise "%delete _path", a row given as block.row, or else the block at _path.
+// What is removed is no longer declared, so that declaring it again is not a duplicate
+func (p *parser) remove(_path string, _col bool) error {
+	parts := strings.Split(_path, ".")
+	if _col && len(parts) < 2 {
+		return ErrBadDirective
+	}
+	last := len(parts) - 1
+	if _col {
+		last--
+	}
+	blk := lookupBlock(p.root, parts[:last])
+	if blk == nil {
+		return ErrMissingElement
+	}
+	row, path := blk.rows[parts[last]], strings.Join(parts[:last+1], ".")
+	if _col {
+		if row == nil {
+			return ErrMissingElement
+		}
+		if _, ok := row.cols[parts[last+1]]; !ok {
+			return ErrMissingElement
+		}
+		row.delCol(parts[last+1])
+		p.dropRef(cellKey{blk, parts[last], parts[last+1]})
+		return nil
+	}
+	switch {
+	case row != nil:
+		blk.delRow(parts[last])
+		delete(p.decls, KindRow+" "+path)
+	case blk.tbls[parts[last]] != nil:
+		blk.delBlock(parts[last])
+		for key, dd := range p.decls {
+			if dd.path == path || strings.HasPrefix(dd.path, path+".") {
+				delete(p.decls, key)
+			}
+		}
+	default:
+		return ErrMissingElement
+	}
+	return nil
+}
+
+// finish completes the load of cfg once all files are read, returning the problems found
+func (p *parser) finish(cfg *CfgBlock) error {
+	for _, decl := range p.dups {
+		if decl.warn && p.ld.Warn != nil {
+			p.ld.Warn(&DuplicateError{decl.kind, decl.path, decl.defs})
+		} else if decl.warn && p.ld.Verbose {
+			fmt.Println("qcfg: warning:", &DuplicateError{decl.kind, decl.path, decl.defs})
 		}
 	}
-	return
+	p.resolveExtends(cfg)
+	p.errs = append(p.errs, resolveRefs(cfg, p.refs)...)
+	if len(p.errs) > 0 {
+		return p.errs
+	}
+	return nil
+}
+
+// errorAt records a problem at line _line of src, _col is the 1-based column of _text within the line
+func (p *parser) errorAt(src *cfgSource, _line int, _col int, _text []byte, _err error) {
+	p.errs = append(p.errs, &ParseError{src.fname, _line, _col, string(_text), src.chain(), _err})
+}
+
+// textCol returns the 1-based column at which _text starts within _line
+func textCol(_line, _text []byte) int {
+	nn := bytes.Index(_line, _text)
+	if nn < 0 || len(_text) < 1 {
+		return 1
+	}
+	return nn + 1
 }
 
-// Recursive call to read a file
-func (cfg CfgBlock) loadCfgFile(_fname string, _rdr *bufio.Reader, _verbose bool) {
-	done := false
+// Recursive call to read a block from src into cfg.
+// _header is the "%block" line (found at column _headerCol) that opened cfg, or nil when reading a whole file, which then ends at EOF rather than at "}".
+// Problems are recorded in p.errs and reading carries on, so that a single load reports all of them
+func (p *parser) loadBlock(cfg *CfgBlock, src *cfgSource, _header []byte, _headerCol int) {
+	headerLine := src.line
 	var prevRow []byte
-	for done == false {
-		buf, err := _rdr.ReadBytes('\n')
-		if err != nil {
-			done = true
+	for {
+		raw, ok := src.readLine()
+		if !ok {
+			break
 		}
+		buf := raw
+		cleanLine(&buf)
 		if len(buf) < 1 {
 			continue
 		}
-		buf = buf[:len(buf)-1]
-		cleanLine(&buf)
-		if len(buf) < 1 {
+		if p.ld.Raw && buf[0] == '%' && (!lineIsBlockNew(buf) || bytes.Contains(bytes.ToLower(buf), []byte(" %extends "))) {
+			p.errorAt(src, src.line, textCol(raw, buf), buf, ErrNotAllowed)
+			continue
+		}
+		if lineIsDirective(buf, "%if") || lineIsDirective(buf, "%else") || lineIsDirective(buf, "%endif") {
+			if p.ld.NoConditions {
+				p.errorAt(src, src.line, textCol(raw, buf), buf, ErrNotAllowed)
+				continue
+			}
+			if err := p.condition(src, stripComment(raw)); err != nil { // "%if env == \"a#b\"" is no comment
+				p.errorAt(src, src.line, textCol(raw, buf), buf, err)
+			}
+			continue
+		}
+		if src.skipping() {
+			skipRow(src) // a heredoc value may hold lines such as %endif
 			continue
 		}
 		if false {
 		} else if lineIsInclude(buf) {
 			// recursive call, which assumes there was no partially unconsumed line
-			fname2 := expandUser(string(getFilename(bytes.TrimSpace(buf))))
-			if _verbose {
-				fmt.Println("qcfg.loadCfgFile: opening file", fname2)
+			fname1, params, optional := getFilename(bytes.TrimSpace(buf))
+			if len(fname1) < 1 {
+				p.errorAt(src, src.line, textCol(raw, buf), buf, ErrBadDirective) // e.g. "%include_optinal x.cfg"
+				continue
+			}
+			fname2, err := p.ld.expand(string(fname1), src.vars)
+			if err != nil {
+				p.errorAt(src, src.line, textCol(raw, fname1), buf, err)
+				continue
 			}
-			fpNew, err := os.Open(fname2)
+			vars, err := parseParams(params, func(_s string) (string, error) { return p.ld.expand(_s, src.vars) })
 			if err != nil {
-				panic("could not open file " + fname2)
+				p.errorAt(src, src.line, textCol(raw, params), buf, err)
+				continue
+			}
+			fnames, err := p.ld.expandInclude(fname2, src.fname)
+			for _, fname2 := range fnames {
+				if err := p.loadFile(cfg, fname2, src, vars); err != nil && !(optional && errors.Is(err, fs.ErrNotExist)) {
+					p.errorAt(src, src.line, textCol(raw, fname1), buf, err)
+				}
+			}
+			if err != nil && !(optional && errors.Is(err, fs.ErrNotExist)) {
+				p.errorAt(src, src.line, textCol(raw, fname1), buf, err)
 			}
-			rdrNew := bufio.NewReader(fpNew)
-			cfg.loadCfgFile(fname2, rdrNew, _verbose)
-			fpNew.Close()
 		} else if lineIsBlockEnd(buf) {
-			// processBlock, which assumes there was no partially unconsumed line
+			if _header == nil {
+				p.errorAt(src, src.line, textCol(raw, buf), buf, ErrUnmatchedBlockEnd)
+				continue
+			}
+			if cfg.syn.close == nil {
+				cfg.syn.close = src.cur() // kept at the first declaration of a block reopened under DupMerge
+			}
+			cfg.syn.lines = append(cfg.syn.lines, src.cur())
 			return
 		} else if lineIsBlockNew(buf) {
 			// processBlock, which assumes there was no partially unconsumed line
-			name2 := string(getBlockname(buf))
-			cfg.tbls[name2] = &CfgBlock{name2, _fname, make(map[string](*cfgRow), 1), make(map[string](*CfgBlock), 1)}
-			cfg.tbls[name2].loadBlock(_rdr, _fname, name2, _verbose)
+			name, parent := getBlockname(buf)
+			name2, err := p.expandName(string(name), src)
+			if err != nil {
+				p.errorAt(src, src.line, textCol(raw, name), buf, err) // the block is still read, under its name as written
+			}
+			dup := p.declare(KindBlock, p.paths[cfg]+name2, src)
+			if dup != nil && src.dup == DupError {
+				p.errorAt(src, src.line, textCol(raw, buf), buf, dup)
+			}
+			blk := cfg.tbls[name2]
+			if dup == nil || src.dup != DupMerge {
+				blk = newCfgBlock(name2, src.fname)
+				blk.syn = &cstBlock{doc: p.doc, file: src.file}
+				cfg.setBlock(name2, blk)
+				if p.paths == nil {
+					p.paths = make(map[*CfgBlock]string)
+				}
+				p.paths[blk] = p.paths[cfg] + name2 + "."
+			}
+			if blk.syn != nil {
+				blk.syn.lines = append(blk.syn.lines, src.cur())
+			}
+			if parent != nil {
+				parent2, err := p.expandName(string(parent), src)
+				if err != nil {
+					p.errorAt(src, src.line, textCol(raw, parent), buf, err)
+				}
+				pos := ParseError{src.fname, src.line, textCol(raw, parent), string(buf), src.chain(), nil}
+				p.extends = append(p.extends, &extension{blk, cfg, parent2, pos})
+			}
+			p.loadBlock(blk, src, buf, textCol(raw, buf))
+		} else if lineIsDirective(buf, "%duplicates") {
+			policy, ok := dupPolicies[strings.ToLower(strings.TrimSpace(string(buf[len("%duplicates"):])))]
+			if !ok {
+				p.errorAt(src, src.line, textCol(raw, buf), buf, ErrBadDirective)
+				continue
+			}
+			src.dup = policy
+		} else if lineIsDirective(buf, "%unset") || lineIsDirective(buf, "%delete") {
+			words, starts := splitWords(buf)
+			if len(words) < 2 {
+				p.errorAt(src, src.line, textCol(raw, buf), buf, ErrBadDirective)
+			}
+			for ii := 1; ii < len(words); ii++ {
+				elem, err := p.expandName(string(words[ii]), src)
+				if err == nil {
+					err = p.remove(elem, lineIsDirective(buf, "%unset"))
+				}
+				if err != nil {
+					p.errorAt(src, src.line, textCol(raw, buf)+starts[ii], buf, err)
+				}
+			}
+		} else if lineIsDirective(buf, "%define") {
+			vars, err := parseParams(buf[len("%define"):], func(_s string) (string, error) { return p.ld.expand(_s, src.vars) })
+			if err != nil || len(vars) < 1 {
+				if err == nil {
+					err = ErrBadDirective
+				}
+				p.errorAt(src, src.line, textCol(raw, buf), buf, err)
+				continue
+			}
+			for name, val := range vars {
+				src.vars[name] = val
+			}
 		} else if (len(buf) > 2) && (buf[0] == '+') && (buf[1] == '=') {
-			fmt.Printf("loadCfgFile: will loadRow add(%s)\n", string(buf), _verbose)
-			prevRow = cfg.loadRow(buf[2:], _fname, prevRow)
+			if p.ld.Verbose {
+				fmt.Printf("qcfg.loadBlock: will loadRow add(%s)\n", string(buf))
+			}
+			var err error
+			line := src.line
+			if prevRow, err = p.loadRow(cfg, src, prevRow); err != nil {
+				p.errorAt(src, line, textCol(raw, buf), buf, err)
+			}
 		} else if (len(buf) > 0) && (buf[0] == '{') {
 		} else {
-			fmt.Printf("loadCfgFile: will loadRow new(%s)\n", string(buf))
-			prevRow = cfg.loadRow(buf, _fname, nil)
+			if p.ld.Verbose {
+				fmt.Printf("qcfg.loadBlock: will loadRow new(%s)\n", string(buf))
+			}
+			var err error
+			line := src.line
+			if prevRow, err = p.loadRow(cfg, src, nil); err != nil {
+				p.errorAt(src, line, textCol(raw, buf), buf, err)
+			}
+		}
+	}
+	if _header != nil {
+		p.errs = append(p.errs, &ParseError{src.fname, headerLine, _headerCol, string(_header), src.chain(), ErrUnterminatedBlock})
+	}
+}
+
+// Recursive call to read a file into cfg, _from is the file that included it with the parameters _params.
+// Only the failure to include or open the file is returned, problems within it are recorded in p.errs
+func (p *parser) loadFile(cfg *CfgBlock, _fname string, _from *cfgSource, _params map[string]string) error {
+	if _from != nil {
+		if _from.depth >= p.ld.maxIncludeDepth() {
+			return ErrIncludeDepth
+		}
+		key := p.ld.fileKey(_fname)
+		for ss := _from; ss != nil; ss = ss.parent {
+			if ss.key == key {
+				files := []string{_fname}
+				for ss = _from; ss.key != key; ss = ss.parent {
+					files = append([]string{ss.fname}, files...)
+				}
+				return &IncludeCycleError{append([]string{ss.fname}, files...)}
+			}
+		}
+	}
+	if p.ld.Verbose {
+		fmt.Println("qcfg.loadFile: opening file", _fname)
+	}
+	fp, err := p.ld.open(_fname)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	file := p.loadReader(cfg, _fname, fp, _from, _params)
+	if p.ld.FS == nil {
+		file.path = _fname
+	}
+	return nil
+}
+
+// loadReader reads the content of the file _fname from _rdr into cfg, returning the lines read.
+// The variables of the file are those of _from, or Loader.Vars for the top-level file, with _params added
+func (p *parser) loadReader(cfg *CfgBlock, _fname string, _rdr io.Reader, _from *cfgSource, _params map[string]string) *cstFile {
+	file := &cstFile{fname: _fname}
+	if p.doc == nil {
+		p.doc = &cstDoc{root: file, raw: p.ld.Raw}
+		cfg.syn = &cstBlock{doc: p.doc, file: file}
+		p.root = cfg
+	}
+	p.doc.files = append(p.doc.files, file)
+	src := &cfgSource{fname: _fname, key: p.ld.fileKey(_fname), rdr: bufio.NewReader(_rdr), parent: _from, file: file, dup: p.ld.Duplicates}
+	vars := p.ld.Vars
+	if _from != nil {
+		src.depth, src.dup, vars = _from.depth+1, _from.dup, _from.vars
+	}
+	src.vars = make(map[string]string, len(vars)+len(_params)) // a copy, so that %define within the file does not reach its includer
+	for name, val := range vars {
+		src.vars[name] = val
+	}
+	for name, val := range _params {
+		src.vars[name] = val
+	}
+	p.loadBlock(cfg, src, nil, 0)
+	for _, cond := range src.conds {
+		p.errs = append(p.errs, &ParseError{src.fname, cond.line, 1, cond.text, src.chain(), ErrUnterminatedCond})
+	}
+	return file
+}
+
+// Loader reads config files into memory, reporting every failure as an error instead of panicking.
+// The zero value is ready to use, and reads files from the OS filesystem.
+//
+// With Raw only the named file is read and ${...} is neither substituted nor resolved, values keeping it as written.
+// %include and every other directive, %extends, %from and single-quoted values holding "${" are reported as ErrNotAllowed,
+// as what they mean would be lost when the config is written back with CfgWrite and WriteOptions.Raw
+type Loader struct {
+	FS              fs.FS                       // when set, the top-level file and all included files are opened from FS instead
+	IncludePath     []string                    // directories searched for an included file not found relative to the including file
+	MaxIncludeDepth int                         // how deeply %include may nest, DefaultMaxIncludeDepth when 0
+	NoEnv           bool                        // leave ${VAR} in values and include paths as is
+	LookupEnv       func(string) (string, bool) // looks up ${VAR}, os.LookupEnv when nil
+	Verbose         bool                        // print progress to stdout while loading
+	Duplicates      DupPolicy                   // for blocks and rows declared again, unless changed by %duplicates
+	Warn            func(error)                 // called with each warning, such as a *DuplicateError, once loading is done
+	Vars            map[string]string           // substituted as ${NAME} before the environment, also when NoEnv, as %define does
+	Raw             bool                        // read the file as written, for tools that write it back, see above
+	NoConditions    bool                        // report %if, %else and %endif as ErrNotAllowed, for tools that must not skip any line
+}
+
+// DefaultMaxIncludeDepth is the nesting limit for %include when Loader.MaxIncludeDepth is not set
+const DefaultMaxIncludeDepth = 32
+
+func (ld *Loader) maxIncludeDepth() int {
+	if ld.MaxIncludeDepth > 0 {
+		return ld.MaxIncludeDepth
+	}
+	return DefaultMaxIncludeDepth
+}
+
+// fileKey returns a name that is the same for every path that refers to _fname
+func (ld *Loader) fileKey(_fname string) string {
+	if ld.FS != nil {
+		return path.Clean(_fname)
+	}
+	if abs, err := filepath.Abs(_fname); err == nil {
+		return abs
+	}
+	return filepath.Clean(_fname)
+}
+
+// open opens a config file from ld.FS, or the OS filesystem
+func (ld *Loader) open(_fname string) (io.ReadCloser, error) {
+	if ld.FS != nil {
+		return ld.FS.Open(_fname)
+	}
+	return os.Open(_fname)
+}
+
+// exists reports whether _fname can be found in ld.FS, or the OS filesystem
+func (ld *Loader) exists(_fname string) bool {
+	var err error
+	if ld.FS != nil {
+		_, err = fs.Stat(ld.FS, _fname)
+	} else {
+		_, err = os.Stat(_fname)
+	}
+	return err == nil
+}
+
+// includeCandidates lists the paths that "%include _inc" within the file _from may refer to, in order of preference.
+// Relative names are looked for first in the directory of _from, then in each directory of ld.IncludePath,
+// and finally relative to the working directory (or the root of ld.FS)
+func (ld *Loader) includeCandidates(_inc string, _from string) []string {
+	_inc = ld.expandPath(_inc)
+	join, dir, isAbs := filepath.Join, filepath.Dir, filepath.IsAbs
+	if ld.FS != nil {
+		join, dir, isAbs = path.Join, path.Dir, func(string) bool { return false }
+	}
+	if isAbs(_inc) {
+		return []string{_inc}
+	}
+	candidates := []string{join(dir(_from), _inc)}
+	for _, ip := range ld.IncludePath {
+		candidates = append(candidates, join(ld.expandPath(ip), _inc))
+	}
+	return append(candidates, join(_inc))
+}
+
+// resolveInclude returns the file named by "%include _inc" within the file _from, see includeCandidates.
+// When none of the candidates exist the first is returned, so that the caller reports it as missing
+func (ld *Loader) resolveInclude(_inc string, _from string) string {
+	candidates := ld.includeCandidates(_inc, _from)
+	for _, cc := range candidates {
+		if ld.exists(cc) {
+			return cc
 		}
 	}
+	return candidates[0]
+}
+
+// expandInclude returns the files, in lexical order, to be read for "%include _inc" within the file _from.
+// _inc may be a glob pattern, which must match at least one file, or a directory, whose *.cfg files are read
+func (ld *Loader) expandInclude(_inc string, _from string) ([]string, error) {
+	if strings.ContainsAny(_inc, "*?[") {
+		for _, pattern := range ld.includeCandidates(_inc, _from) {
+			if fnames := ld.glob(pattern); len(fnames) > 0 {
+				return fnames, nil
+			}
+		}
+		return nil, &fs.PathError{Op: "glob", Path: _inc, Err: fs.ErrNotExist}
+	}
+	fname := ld.resolveInclude(_inc, _from)
+	if ld.isDir(fname) {
+		if ld.FS != nil {
+			return ld.glob(path.Join(fname, "*.cfg")), nil
+		}
+		return ld.glob(filepath.Join(fname, "*.cfg")), nil
+	}
+	return []string{fname}, nil
+}
+
+// glob returns the sorted names of the files, but not directories, matching _pattern
+func (ld *Loader) glob(_pattern string) []string {
+	var matches []string
+	if ld.FS != nil {
+		matches, _ = fs.Glob(ld.FS, _pattern)
+	} else {
+		matches, _ = filepath.Glob(_pattern)
+	}
+	fnames := []string{}
+	for _, mm := range matches {
+		if !ld.isDir(mm) {
+			fnames = append(fnames, mm)
+		}
+	}
+	sort.Strings(fnames)
+	return fnames
+}
+
+// isDir reports whether _fname is a directory in ld.FS, or the OS filesystem
+func (ld *Loader) isDir(_fname string) bool {
+	var fi fs.FileInfo
+	var err error
+	if ld.FS != nil {
+		fi, err = fs.Stat(ld.FS, _fname)
+	} else {
+		fi, err = os.Stat(_fname)
+	}
+	return err == nil && fi.IsDir()
+}
+
+// expand substitutes ${VAR}, ${VAR:-default} and ${VAR:?message} in _s with _vars, then environment variables unless ld.NoEnv
+func (ld *Loader) expand(_s string, _vars map[string]string) (string, error) {
+	if ld.Raw || ld.NoEnv && len(_vars) < 1 {
+		return _s, nil
+	}
+	ve := varExpander{
+		lookup: func(_name string) (string, bool, error) {
+			val, ok := ld.lookupVar(_name, _vars)
+			return val, ok, nil
+		},
+		keep: func(_name string) bool {
+			_, ok := _vars[_name]
+			return isRefName(_name) || ld.NoEnv && !ok
+		},
+	}
+	return ve.expand(_s)
+}
+
+// lookupVar returns the value of the variable _name from _vars, or else the environment unless ld.NoEnv, and whether it is set
+func (ld *Loader) lookupVar(_name string, _vars map[string]string) (string, bool) {
+	if val, ok := _vars[_name]; ok {
+		return val, true
+	}
+	if ld.NoEnv {
+		return "", false
+	}
+	if ld.LookupEnv != nil {
+		return ld.LookupEnv(_name)
+	}
+	return os.LookupEnv(_name)
+}
+
+// expandPath applies expandUser when reading from the OS filesystem, fs.FS paths are left alone
+func (ld *Loader) expandPath(_fname string) string {
+	if ld.FS != nil {
+		return _fname
+	}
+	return expandUser(_fname)
+}
+
+// Load reads and parses a top-level config file (and recursively any config files that are included) with a default Loader
+func Load(_fname string) (*CfgBlock, error) {
+	ld := Loader{}
+	return ld.Load(_fname)
+}
+
+// Load reads and parses a top-level config file (and recursively any config files that are included).
+// A top-level file that cannot be opened is reported as the underlying *os.PathError,
+// any problems within the files as an ErrorList holding a *ParseError for each of them
+func (ld *Loader) Load(_fname string) (*CfgBlock, error) {
+	cfg, err := ld.load(_fname)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// load is Load, but also returns the config as read when there are problems within it, nil only when _fname cannot be read
+func (ld *Loader) load(_fname string) (*CfgBlock, error) {
+	_fname = ld.expandPath(_fname)
+	cfg := newCfgBlock(_fname, _fname)
+	p := parser{ld: ld}
+	if err := p.loadFile(cfg, _fname, nil, nil); err != nil {
+		return nil, err
+	}
+	return cfg, p.finish(cfg)
+}
+
+// LoadReader parses a top-level config from _rdr, any files it includes are opened as for Load.
+// _name stands in for the file name in the returned CfgBlock and in errors
+func (ld *Loader) LoadReader(_name string, _rdr io.Reader) (*CfgBlock, error) {
+	cfg := newCfgBlock(_name, _name)
+	p := parser{ld: ld}
+	p.loadReader(cfg, _name, _rdr, nil, nil)
+	if err := p.finish(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadString parses a top-level config held in _text, see LoadReader
+func (ld *Loader) LoadString(_name, _text string) (*CfgBlock, error) {
+	return ld.LoadReader(_name, strings.NewReader(_text))
+}
+
+// LoadReader parses a top-level config from _rdr with a default Loader, see Loader.LoadReader
+func LoadReader(_name string, _rdr io.Reader) (*CfgBlock, error) {
+	ld := Loader{}
+	return ld.LoadReader(_name, _rdr)
+}
+
+// LoadString parses a top-level config held in _text with a default Loader, see Loader.LoadReader
+func LoadString(_name, _text string) (*CfgBlock, error) {
+	ld := Loader{}
+	return ld.LoadString(_name, _text)
+}
+
+// LoadFS reads and parses the top-level config file _fname, and any config files it includes, from _fsys
+func LoadFS(_fsys fs.FS, _fname string) (*CfgBlock, error) {
+	ld := Loader{FS: _fsys}
+	return ld.Load(_fname)
 }
 
-// NewCfg reads ()and parses) a new top-level config file (and recursively any config files that are included)
+// NewCfg reads (and parses) a new top-level config file (and recursively any config files that are included).
+// It panics when the file or an included file cannot be read, other problems are skipped, and printed when _verbose.
+// Use Load to handle errors instead
 func NewCfg(_name string, _fname string, _verbose bool) *CfgBlock {
-	_fname = expandUser(_fname)
 	cfg, ok := cfgs[_name]
 	if ok {
 		return cfg
 	}
-	cfg = &CfgBlock{_name, _fname, make(map[string](*cfgRow), 1), make(map[string](*CfgBlock), 1)}
-	cfgs[_name] = cfg
-	cfg, ok = cfgs[_name]
-	if !ok {
-		panic("cfg: NewCfg failed for cfg " + _name)
-	}
+	ld := Loader{Verbose: _verbose}
+	cfg, err := ld.load(_fname)
 	if cfg == nil {
-		panic("cfg: NewCfg cfg could not be created for cfg" + _name)
-	}
-	fpNew, err := os.Open(_fname)
-	if err != nil {
-		panic("could not open file " + _fname)
+		panic("cfg: NewCfg failed for cfg " + _name + ": " + err.Error())
+	}
+	var errs ErrorList
+	errors.As(err, &errs)
+	for _, perr := range errs {
+		var pathErr *fs.PathError
+		var cycleErr *IncludeCycleError
+		if errors.As(perr, &pathErr) || errors.As(perr, &cycleErr) || errors.Is(perr, ErrIncludeDepth) {
+			panic("cfg: NewCfg failed for cfg " + _name + ": " + perr.Error())
+		}
+		if _verbose {
+			fmt.Println("qcfg.NewCfg:", perr)
+		}
 	}
-	rdr := bufio.NewReader(fpNew)
-	cfg.loadCfgFile(_fname, rdr, _verbose)
-	fpNew.Close()
+	cfg.name = _name
+	cfgs[_name] = cfg
 	return cfg
 }
 
@@ -313,7 +1508,7 @@ func NewCfgMem(_name string) *CfgBlock {
 	if ok {
 		panic("cfg: NewCfgMem or NewCfg already called for cfg " + _name)
 	}
-	cfg = &CfgBlock{_name, "", make(map[string](*cfgRow), 1), make(map[string](*CfgBlock), 1)}
+	cfg = newCfgBlock(_name, "")
 	cfgs[_name] = cfg
 	cfg, ok = cfgs[_name]
 	if !ok {
@@ -326,42 +1521,135 @@ func NewCfgMem(_name string) *CfgBlock {
 }
 
 // EditEntry updates en element of the in-memory representation of a config file.
-// Use it to modify the configuration for subsequent use of the instance, or in preparation to write a modified config file
+// Use it to modify the configuration for subsequent use of the instance, or in preparation to write a modified config file.
+// For a loaded config the change is also made to its source, see WriteSource, unless %unset or %delete removed the element
 func (cfg *CfgBlock) EditEntry(_tbl, _row, _col, value string) {
 	tbl, ok := cfg.tbls[_tbl]
 	if ok == false {
-		cfg.tbls[_tbl] = &CfgBlock{cfg.name, "", make(map[string](*cfgRow), 1), make(map[string](*CfgBlock), 1)}
-		tbl = cfg.tbls[_tbl]
+		tbl = newCfgBlock(_tbl, cfg.fname)
+		cfg.setBlock(_tbl, tbl)
 	}
 	row, ok := tbl.rows[_row]
 	if ok == false {
-		tbl.rows[_row] = &cfgRow{_row, make(map[string]string)}
-		row = tbl.rows[_row]
+		row = newCfgRow(_row)
+		tbl.setRow(row)
 	}
-	row.cols[_col] = value
+	row.setCol(_col, value)
+	cfg.editSource(tbl, row, _col, value)
 }
 
-// CfgWrite is used to programmatically create a new config file by writing out its in-memory representation
-func (cfg CfgBlock) CfgWrite(_filename string) {
-	_filename = expandUser(_filename)
-	fp, err := os.OpenFile(_filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
-	if err != nil {
-		panic("Cannot open filename : " + _filename + " Error :" + err.Error())
+// CfgWrite is used to programmatically create a new config file by writing out its in-memory representation.
+// The whole hierarchy is written, top-level rows and nested blocks included, so that reading the file back gives the same config.
+// The file is replaced atomically, see WriteOptions
+func (cfg CfgBlock) CfgWrite(_filename string, _opts ...WriteOptions) error {
+	var buf bytes.Buffer
+	bb := bufio.NewWriter(&buf)
+	raw := len(_opts) > 0 && _opts[0].Raw
+	cfg.writeRows(bb, "", raw)
+	for _, tbl := range cfg.tblOrder {
+		cfg.tbls[tbl].writeBlock(bb, tbl, "", raw)
 	}
-	bb := bufio.NewWriter(fp)
-	for tbl, tblcontent := range cfg.tbls {
-		bb.WriteString("\n%block " + tbl + "\n{\n")
-		for rowname, rowcontent := range tblcontent.rows {
-			bb.WriteString("\t" + rowname + "\t:: ")
-			for colname, value := range rowcontent.cols {
-				bb.WriteString(colname + "=" + value + "; ")
+	bb.Flush()
+	return writeFile(expandUser(_filename), buf.Bytes(), _opts)
+}
+
+// WriteOptions control how CfgWrite, SaveAll and WriteFile replace a config file.
+// The content is written to a temporary file in the same directory, synced to disk and renamed over the file,
+// so that a crash leaves either the old or the new content, never a truncated file
+type WriteOptions struct {
+	Backup bool        // keep the previous content of the file as fname+".bak"
+	Perm   os.FileMode // permissions of a new file, 0644 when 0; an existing file keeps its own
+	Raw    bool        // for CfgWrite of a config read by Loader.Raw: values holding ${...} are written so that it is substituted when read
+}
+
+// WriteFile atomically replaces the file _fname with _data, as CfgWrite and SaveAll do, e.g. for the output of Format.
+// Only the first of _opts is used
+func WriteFile(_fname string, _data []byte, _opts ...WriteOptions) error {
+	return writeFile(_fname, _data, _opts)
+}
+
+// writeFile atomically replaces the file _fname with _data, see WriteOptions. Only the first of _opts is used
+func writeFile(_fname string, _data []byte, _opts []WriteOptions) error {
+	var opts WriteOptions
+	if len(_opts) > 0 {
+		opts = _opts[0]
+	}
+	perm := opts.Perm
+	if perm == 0 {
+		perm = 0644
+	}
+	if fname, err := filepath.EvalSymlinks(_fname); err == nil {
+		_fname = fname // replace the target of a symlink, not the link
+	}
+	fi, err := os.Stat(_fname)
+	if err == nil {
+		perm = fi.Mode().Perm()
+		if opts.Backup {
+			old, err := os.ReadFile(_fname)
+			if err != nil {
+				return err
+			}
+			if err := writeFile(_fname+".bak", old, []WriteOptions{{Perm: perm}}); err != nil {
+				return err
 			}
-			bb.WriteString("\n")
 		}
-		bb.WriteString("\n}\n")
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
 	}
-	bb.Flush()
-	fp.Close()
+
+	dir, base := filepath.Split(_fname)
+	if dir == "" {
+		dir = "."
+	}
+	fp, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := fp.Name()
+	_, err = fp.Write(_data)
+	if err == nil {
+		err = fp.Chmod(perm)
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, _fname)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dp, err := os.Open(dir); err == nil {
+		dp.Sync() // make the rename durable, where the OS allows syncing a directory
+		dp.Close()
+	}
+	return nil
+}
+
+// writeRows writes each row of cfg (but not of its nested blocks) on one line, indented by _indent
+func (cfg *CfgBlock) writeRows(bb *bufio.Writer, _indent string, _raw bool) {
+	for _, rowname := range cfg.rowOrder {
+		rowcontent := cfg.rows[rowname]
+		bb.WriteString(_indent + rowname + "\t:: ")
+		for _, colname := range rowcontent.colOrder {
+			bb.WriteString(colname + "=" + quoteValue(rowcontent.cols[colname], _raw) + "; ")
+		}
+		bb.WriteString("\n")
+	}
+}
+
+// writeBlock writes cfg as "%block _name", with its rows and recursively its nested blocks, indented by _indent
+func (cfg *CfgBlock) writeBlock(bb *bufio.Writer, _name string, _indent string, _raw bool) {
+	bb.WriteString("\n" + _indent + "%block " + _name + "\n" + _indent + "{\n")
+	cfg.writeRows(bb, _indent+"\t", _raw)
+	for _, tbl := range cfg.tblOrder {
+		cfg.tbls[tbl].writeBlock(bb, tbl, _indent+"\t", _raw)
+	}
+	bb.WriteString(_indent + "}\n")
 }
 
 // Str is used to query an element of the in-memory representation of the config file, as type string.  It returns the specified default if the element is missing
@@ -591,16 +1879,10 @@ func (cfg CfgBlock) NestedFloat64(_tbls []string, _row, _col string, _def float6
 	return cfg1.Float64(_tbls[nn], _row, _col, _def)
 }
 
-// GetBlocks returns a list of names of all the blocks (aka blocks) within the current block
+// GetBlocks returns a list of names of all the blocks (aka blocks) within the current block, in declaration order
 // Use it when you want to process an entire config file
 func (cfg CfgBlock) GetBlocks() []string {
-	blocks := make([]string, len(cfg.tbls))
-	ii := 0
-	for kk := range cfg.tbls {
-		blocks[ii] = kk
-		ii++
-	}
-	return blocks
+	return append([]string{}, cfg.tblOrder...)
 }
 
 // GetBlock	returns the block found by following down a block hierarchy
@@ -616,30 +1898,26 @@ func (cfg CfgBlock) GetBlock(_blockPath []string) *CfgBlock {
 	return cfg1
 }
 
-// GetRows returns a list of names of all rows within a specific block (block)
+// GetRows returns a list of names of all rows within a specific block (block), in declaration order
 func (cfg CfgBlock) GetRows(_tbl string) []string {
 	rows := []string{}
 	tbl, ok := cfg.tbls[_tbl]
 	if ok {
-		for rr := range tbl.rows {
-			rows = append(rows, rr)
-		}
+		rows = append(rows, tbl.rowOrder...)
 	} else {
 		fmt.Printf("did not find tbl (%s)\n", _tbl)
 	}
 	return rows
 }
 
-// GetCols returns a list of names of all columns within a specific rows of a specific block (block)
+// GetCols returns a list of names of all columns within a specific rows of a specific block (block), in declaration order
 func (cfg CfgBlock) GetCols(_tbl, _row string) []string {
 	cols := []string{}
 	tbl, ok := cfg.tbls[_tbl]
 	if ok {
 		row, ok1 := tbl.rows[_row]
 		if ok1 {
-			for cc := range row.cols {
-				cols = append(cols, cc)
-			}
+			cols = append(cols, row.colOrder...)
 		} else {
 			fmt.Printf("did not find row (%s) in tbl (%s)\n", _row, _tbl)
 		}
@@ -649,6 +1927,19 @@ func (cfg CfgBlock) GetCols(_tbl, _row string) []string {
 	return cols
 }
 
+// Sort orders the blocks, rows and columns of cfg, and of the blocks nested within it, alphabetically instead of in declaration order.
+// The new order is that of GetBlocks, GetRows, GetCols and CfgWrite
+func (cfg *CfgBlock) Sort() {
+	sort.Strings(cfg.tblOrder)
+	sort.Strings(cfg.rowOrder)
+	for _, row := range cfg.rows {
+		sort.Strings(row.colOrder)
+	}
+	for _, tbl := range cfg.tbls {
+		tbl.Sort()
+	}
+}
+
 // RowExists is used to verify if a specific row exists within a specific block (block)
 func (cfg CfgBlock) RowExists(block, row string) bool {
 	tbl, ok := cfg.tbls[block]
@@ -669,7 +1960,7 @@ func (cfg CfgBlock) Split(_tbl, _row, _col string, _def string) []string {
 
 // Expandlist is a shorthand method
 // If box.row.col == "foo1,foo2,..."
-// then return unique list of {box.row2.foo1, box.row2.foo2, ...}
+// then return unique list of {box.row2.foo1, box.row2.foo2, ...}, in the order first found
 func (cfg *CfgBlock) Expandlist(_block, _row, _col, _row2 string) []string {
 	parts := []string{}
 	switch {
@@ -686,13 +1977,12 @@ func (cfg *CfgBlock) Expandlist(_block, _row, _col, _row2 string) []string {
 	partsmap := map[string]bool{}
 	for _, boxtype := range cfg.Split(_block, _row, _col, "") {
 		for _, box := range cfg.Split(_block, _row2, boxtype, "") {
-			partsmap[box] = true
+			if !partsmap[box] {
+				partsmap[box] = true
+				parts = append(parts, box)
+			}
 		}
 	}
-
-	for kk := range partsmap {
-		parts = append(parts, kk)
-	}
 	return parts
 }
 
@@ -1,11 +1,16 @@
 package qcfg
 
 import (
+	"errors"
+	"io/fs"
 	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 var cfgFile = "_sample.cfg"
@@ -15,6 +20,23 @@ func TestInitFile(t *testing.T) {
 	NewCfg("TestInitFile", cfgFile, false)
 }
 
+// To test that NewCfg() skips problems within a file but panics on a file it cannot read
+func TestNewCfgTolerance(t *testing.T) {
+	dir := t.TempDir()
+	fname := writeCfgFile(t, dir, "stray.cfg", "%block b1\n{\n  row1 :: a=1;\n  this is not a row\n}\n}\nrow2 :: b=${b1.nope.x};\n")
+	cfg := NewCfg("TestNewCfgTolerance", fname, false)
+	if cfg.Str("b1", "row1", "a", "") != "1" {
+		t.Error("Expected the rows around the problems to be read")
+	}
+	fname = writeCfgFile(t, dir, "inc.cfg", "%include "+filepath.Join(dir, "AXCFTWERdsr54.cfg")+"\n")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected NewCfg to panic on a missing included file")
+		}
+	}()
+	NewCfg("TestNewCfgTolerance2", fname, false)
+}
+
 // To test NewCfgMem()
 func TestInitMem(t *testing.T) {
 	NewCfgMem("TestInitMem")
@@ -150,9 +172,17 @@ func TestCfgWrite(t *testing.T) {
 	if err != nil {
 		t.Log("Warning : Could not close the tempfile", tempfile, "err =", err)
 	}
-	cfg.CfgWrite(tempfile)
-	cfg = NewCfg("TestCfgWrite_2", tempfile, false)
-	if cfg.Str("block4", "anotherrow", "millis", "BLANK") != "123456789" {
+	if err := cfg.CfgWrite(tempfile); err != nil {
+		t.Fatal("CfgWrite failed, err =", err)
+	}
+	cfg2 := NewCfg("TestCfgWrite_2", tempfile, false)
+	if cfg2.Str("block4", "anotherrow", "millis", "BLANK") != "123456789" {
+		t.Fail()
+	}
+	if !isTreeEqual(cfg, cfg2) {
+		t.Error("Expected the written config to read back the same, including nested blocks")
+	}
+	if cfg2.NestedStr([]string{"oneblock", "lowerblock0", "lowerblock"}, "inner-row", "milli", "BLANK") != "1234567890" {
 		t.Fail()
 	}
 	err = os.Remove(tempfile)
@@ -160,6 +190,883 @@ func TestCfgWrite(t *testing.T) {
 		t.Log("Warning : Could not remove temp file", tempfile, "err =", err)
 	}
 }
+
+// To test Load()
+func TestLoad(t *testing.T) {
+	cfg, err := Load(cfgFile)
+	if err != nil {
+		t.Fatal("Load failed, err =", err)
+	}
+	if cfg.Int("thirdblock", "some-row", "numProcs", -1) != 8 {
+		t.Fail()
+	}
+	if _, err = Load("AXCFTWERdsr54.cfg"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a not-exist error for a missing file, got %v", err)
+	}
+}
+
+// To test the errors returned by Load()
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    error
+	}{
+		{"%include " + filepath.Join(dir, "AXCFTWERdsr54.cfg") + "\n", os.ErrNotExist},
+		{"%block b1\n{\n  row1 :: a=1;\n  this is not a row\n}\n", ErrMalformedRow},
+		{"%block b1\n{\n  row1 :: a=1;\n", ErrUnterminatedBlock},
+		{"row1 :: a=1;\n}\n", ErrUnmatchedBlockEnd},
+		{"%include_optinal other.cfg\n", ErrBadDirective},
+		{"%includes x\n", ErrBadDirective},
+	}
+	for ii, tt := range tests {
+		fname := writeCfgFile(t, dir, "test.cfg", tt.content)
+		_, err := Load(fname)
+		var perr *ParseError
+		if !errors.As(err, &perr) || !errors.Is(err, tt.want) {
+			t.Errorf("case %d: expected *ParseError wrapping %v, got %v", ii, tt.want, err)
+		}
+	}
+}
+
+// To test the positions and include chain recorded in each ParseError
+func TestParseErrorPositions(t *testing.T) {
+	dir := t.TempDir()
+	inner := writeCfgFile(t, dir, "inner.cfg", "%block b1\n{\n  row1 :: a=1;\n    not a row\n}\n  %block b2\n{\n")
+	outer := writeCfgFile(t, dir, "outer.cfg", "# outer\n%include "+inner+"\nrow2 :: b=2;\n")
+	_, err := Load(outer)
+	var errs ErrorList
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Expected an ErrorList with 2 errors, got %v", err)
+	}
+	want := []ParseError{
+		{Fname: inner, Line: 4, Col: 5, Text: "not a row", Chain: []string{outer + ":2"}, Err: ErrMalformedRow},
+		{Fname: inner, Line: 6, Col: 3, Text: "%block b2", Chain: []string{outer + ":2"}, Err: ErrUnterminatedBlock},
+	}
+	for ii, ww := range want {
+		ee := errs[ii]
+		if ee.Fname != ww.Fname || ee.Line != ww.Line || ee.Col != ww.Col || ee.Text != ww.Text ||
+			len(ee.Chain) != 1 || ee.Chain[0] != ww.Chain[0] || ee.Err != ww.Err {
+			t.Errorf("Expected error = %+v\nActual error = %+v\n", ww, *ee)
+		}
+	}
+}
+
+// To test LoadFS()
+func TestLoadFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.cfg":          {Data: []byte("%include common/db.cfg\n%block app\n{\n  web :: port=8080;\n}\n")},
+		"common/db.cfg":     {Data: []byte("%block db\n{\n  primary :: host=db1; port=5432;\n}\n")},
+		"AXCFTWERdsr54.cfg": {Data: []byte("%include AXCFTWERdsr54/missing.cfg\n")},
+	}
+	cfg, err := LoadFS(fsys, "main.cfg")
+	if err != nil {
+		t.Fatal("LoadFS failed, err =", err)
+	}
+	if cfg.Int("app", "web", "port", 0) != 8080 || cfg.Int("db", "primary", "port", 0) != 5432 {
+		t.Fail()
+	}
+	if _, err = LoadFS(fsys, "AXCFTWERdsr54.cfg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a not-exist error for a missing include, got %v", err)
+	}
+}
+
+// To test LoadString() and LoadReader()
+func TestLoadString(t *testing.T) {
+	text := "%block app\n{\n  web :: port=8080;\n}\n"
+	cfg, err := LoadString("app.cfg", text)
+	if err != nil {
+		t.Fatal("LoadString failed, err =", err)
+	}
+	if cfg.Int("app", "web", "port", 0) != 8080 {
+		t.Fail()
+	}
+	ld := Loader{FS: fstest.MapFS{"db.cfg": {Data: []byte("%block db\n{\n  primary :: host=db1;\n}\n")}}}
+	cfg, err = ld.LoadReader("app.cfg", strings.NewReader("%include db.cfg\n"+text))
+	if err != nil {
+		t.Fatal("LoadReader failed, err =", err)
+	}
+	if cfg.Str("db", "primary", "host", "") != "db1" {
+		t.Fail()
+	}
+}
+
+// To test that includes are resolved relative to the including file, then along IncludePath
+func TestIncludeRelative(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "app", "conf"), 0755)
+	os.MkdirAll(filepath.Join(dir, "shared"), 0755)
+	writeCfgFile(t, dir, "app/conf/db.cfg", "%block db\n{\n  primary :: host=db1;\n}\n")
+	writeCfgFile(t, dir, "shared/log.cfg", "%block log\n{\n  main :: level=info;\n}\n")
+	main := writeCfgFile(t, dir, "app/main.cfg", "%include conf/db.cfg\n%include log.cfg\n")
+	if _, err := Load(main); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected log.cfg to be missing without an IncludePath, got %v", err)
+	}
+	ld := Loader{IncludePath: []string{filepath.Join(dir, "shared")}}
+	cfg, err := ld.Load(main)
+	if err != nil {
+		t.Fatal("Load failed, err =", err)
+	}
+	if cfg.Str("db", "primary", "host", "") != "db1" || cfg.Str("log", "main", "level", "") != "info" {
+		t.Fail()
+	}
+
+	fsys := fstest.MapFS{
+		"app/main.cfg":    {Data: []byte("%include conf/db.cfg\n")},
+		"app/conf/db.cfg": {Data: []byte("%block db\n{\n  primary :: host=db2;\n}\n")},
+	}
+	if cfg, err = LoadFS(fsys, "app/main.cfg"); err != nil || cfg.Str("db", "primary", "host", "") != "db2" {
+		t.Errorf("LoadFS did not resolve the include relative to app/, err = %v", err)
+	}
+}
+
+// To test include cycle detection and the include depth limit
+func TestIncludeCycle(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.cfg":    {Data: []byte("%include b.cfg\n")},
+		"b.cfg":    {Data: []byte("row1 :: x=1;\n%include ./a.cfg\n")},
+		"self.cfg": {Data: []byte("%include self.cfg\n")},
+		"d0.cfg":   {Data: []byte("%include d1.cfg\n")},
+		"d1.cfg":   {Data: []byte("%include d2.cfg\n")},
+		"d2.cfg":   {Data: []byte("row1 :: x=1;\n")},
+	}
+	_, err := LoadFS(fsys, "a.cfg")
+	var cerr *IncludeCycleError
+	if !errors.As(err, &cerr) || strings.Join(cerr.Files, ",") != "a.cfg,b.cfg,a.cfg" {
+		t.Errorf("Expected an include cycle a.cfg -> b.cfg -> a.cfg, got %v", err)
+	}
+	if _, err = LoadFS(fsys, "self.cfg"); !errors.As(err, &cerr) {
+		t.Errorf("Expected an include cycle for self.cfg, got %v", err)
+	}
+	ld := Loader{FS: fsys, MaxIncludeDepth: 1}
+	if _, err = ld.Load("d0.cfg"); !errors.Is(err, ErrIncludeDepth) {
+		t.Errorf("Expected ErrIncludeDepth, got %v", err)
+	}
+	ld.MaxIncludeDepth = 2
+	if _, err = ld.Load("d0.cfg"); err != nil {
+		t.Errorf("Expected d0.cfg to load within a depth of 2, got %v", err)
+	}
+}
+
+// To test glob, directory and optional includes
+func TestIncludeGlob(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.cfg":         {Data: []byte("%include conf.d/*.cfg\n%include_optional AXCFTWERdsr54.cfg\n%include? nodir/*.cfg\n")},
+		"conf.d/10-a.cfg":  {Data: []byte("%block app\n{\n  web :: port=80; user=a;\n}\n")},
+		"conf.d/20-b.cfg":  {Data: []byte("%block app\n{\n  web :: port=8080;\n}\n")},
+		"conf.d/notes.txt": {Data: []byte("not a config\n")},
+		"dir.cfg":          {Data: []byte("%include conf.d\n")},
+		"strict.cfg":       {Data: []byte("%include nodir/*.cfg\n")},
+	}
+	for _, fname := range []string{"main.cfg", "dir.cfg"} {
+		cfg, err := LoadFS(fsys, fname)
+		if err != nil {
+			t.Fatal("LoadFS failed for", fname, "err =", err)
+		}
+		if cfg.Int("app", "web", "port", 0) != 8080 || cfg.Str("app", "web", "user", "") != "" {
+			t.Errorf("Expected conf.d/20-b.cfg to be read last for %s", fname)
+		}
+	}
+	if _, err := LoadFS(fsys, "strict.cfg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a glob matching nothing to be an error, got %v", err)
+	}
+}
+
+// To test env-variable substitution in values and include paths
+func TestLoadEnv(t *testing.T) {
+	env := map[string]string{"DBHOST": "db9", "CONFD": "conf.d"}
+	fsys := fstest.MapFS{
+		"main.cfg":        {Data: []byte("%include ${CONFD}/db.cfg\napp :: url=http://${DBHOST}:${PORT:-80}/;\n")},
+		"conf.d/db.cfg":   {Data: []byte("%block db\n{\n  primary :: host=${DBHOST};\n}\n")},
+		"required.cfg":    {Data: []byte("app :: key=${APIKEY:?set APIKEY};\n")},
+		"${CONFD}/db.cfg": {Data: []byte("%block db\n{\n  primary :: host=literal;\n}\n")},
+	}
+	ld := Loader{FS: fsys, LookupEnv: func(name string) (string, bool) {
+		val, ok := env[name]
+		return val, ok
+	}}
+	cfg, err := ld.Load("main.cfg")
+	if err != nil {
+		t.Fatal("Load failed, err =", err)
+	}
+	if cfg.Str("db", "primary", "host", "") != "db9" || cfg.SelfStr("app", "url", "") != "http://db9:80/" {
+		t.Errorf("Expected env-variables to be substituted, got host=%s url=%s",
+			cfg.Str("db", "primary", "host", ""), cfg.SelfStr("app", "url", ""))
+	}
+	var verr *UnsetVarError
+	if _, err = ld.Load("required.cfg"); !errors.As(err, &verr) {
+		t.Errorf("Expected an UnsetVarError, got %v", err)
+	}
+	ld.NoEnv = true
+	if cfg, err = ld.Load("main.cfg"); err != nil || cfg.SelfStr("app", "url", "") != "http://${DBHOST}:${PORT:-80}/" ||
+		cfg.Str("db", "primary", "host", "") != "literal" {
+		t.Errorf("Expected NoEnv to leave values alone, err = %v", err)
+	}
+}
+
+// To test cross-references between cells
+func TestLoadRefs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.cfg": {Data: []byte("%include hosts.cfg\n" +
+			"%block app\n{\n  web :: url=http://${hosts.proxy.name}:${hosts.proxy.port}/; backup=${hosts.spare.name:-none};\n" +
+			"  %block inner\n  {\n    job :: log=${paths.logs}/job.log;\n  }\n}\n" +
+			"paths :: root=/srv; logs=${paths.root}/log;\n" +
+			"logdir :: x=${paths.logs};\n" +
+			"copy :: inner=${app.inner.job.log};\n")},
+		"hosts.cfg":    {Data: []byte("%block hosts\n{\n  proxy :: name=10.10.24.5; port=3128;\n}\n")},
+		"dangling.cfg": {Data: []byte("row1 :: a=${nosuchblock.row.col};\n")},
+		"cycle.cfg":    {Data: []byte("row1 :: a=${row2.b};\nrow2 :: b=x${row1.a};\n")},
+	}
+	cfg, err := LoadFS(fsys, "main.cfg")
+	if err != nil {
+		t.Fatal("LoadFS failed, err =", err)
+	}
+	if cfg.Str("app", "web", "url", "") != "http://10.10.24.5:3128/" || cfg.Str("app", "web", "backup", "") != "none" {
+		t.Errorf("Unexpected url=%s backup=%s", cfg.Str("app", "web", "url", ""), cfg.Str("app", "web", "backup", ""))
+	}
+	if cfg.SelfStr("copy", "inner", "") != "/srv/log/job.log" {
+		t.Errorf("Expected a reference into a nested block to be resolved, got %s", cfg.SelfStr("copy", "inner", ""))
+	}
+	if cfg.SelfStr("logdir", "x", "") != "/srv/log" {
+		t.Errorf("Expected a chained reference to be resolved, got %s", cfg.SelfStr("logdir", "x", ""))
+	}
+	var errs ErrorList
+	if _, err = LoadFS(fsys, "dangling.cfg"); !errors.Is(err, ErrDanglingRef) || !errors.As(err, &errs) || errs[0].Line != 1 {
+		t.Errorf("Expected ErrDanglingRef at line 1, got %v", err)
+	}
+	var rerr *RefError
+	if _, err = LoadFS(fsys, "cycle.cfg"); !errors.As(err, &errs) || len(errs) != 1 || !errors.As(err, &rerr) ||
+		strings.Join(rerr.Refs, ",") != "row1.a,row2.b,row1.a" {
+		t.Errorf("Expected one ErrRefCycle row1.a -> row2.b -> row1.a, got %v", err)
+	}
+}
+
+// To test quoted values, and that CfgWrite() quotes them again
+func TestQuotedValues(t *testing.T) {
+	text := `%block db
+{
+  main :: url="http://host/a#frag"; sql = "select 1; -- x=1" ; pass='p;a#s\'s' # comment
+       += pad="  x  "; raw='${HOME}'; esc="a\"b\\c\nd"; plain=a=b; # "not a value
+}
+`
+	ld := Loader{LookupEnv: func(string) (string, bool) { return "/home/x", true }}
+	cfg, err := ld.LoadString("quoted.cfg", text)
+	if err != nil {
+		t.Fatal("LoadString failed, err =", err)
+	}
+	want := map[string]string{"url": "http://host/a#frag", "sql": "select 1; -- x=1", "pass": "p;a#s's",
+		"pad": "  x  ", "raw": "${HOME}", "esc": "a\"b\\c\nd", "plain": "a=b"}
+	check := func(cfg *CfgBlock) {
+		for col, val := range want {
+			if got := cfg.Str("db", "main", col, "BLANK"); got != val {
+				t.Errorf("Expected %s = %q, got %q", col, val, got)
+			}
+		}
+		if len(cfg.GetCols("db", "main")) != len(want) {
+			t.Errorf("Expected columns %v, got %v", want, cfg.GetCols("db", "main"))
+		}
+	}
+	check(cfg)
+
+	tempfile := filepath.Join(t.TempDir(), "quoted.cfg")
+	cfg.CfgWrite(tempfile)
+	if cfg, err = ld.Load(tempfile); err != nil {
+		t.Fatal("Load of written file failed, err =", err)
+	}
+	check(cfg)
+
+	if _, err = LoadString("bad.cfg", "row1 :: a=\"open;\n"); !errors.Is(err, ErrUnterminatedQuote) {
+		t.Errorf("Expected ErrUnterminatedQuote, got %v", err)
+	}
+}
+
+// To test heredoc values, and that CfgWrite() writes them back
+func TestHeredoc(t *testing.T) {
+	text := `%block db
+{
+  report :: query = <<EOT
+    select a, b   # not a comment
+    from t;
+EOT; user=${DBUSER};
+         += tmpl = <<'END'
+Dear ${name},
+  EOT
+END
+  after :: x=1;
+}
+`
+	ld := Loader{LookupEnv: func(string) (string, bool) { return "scott", true }}
+	cfg, err := ld.LoadString("heredoc.cfg", text)
+	if err != nil {
+		t.Fatal("LoadString failed, err =", err)
+	}
+	want := map[string]string{"query": "    select a, b   # not a comment\n    from t;", "user": "scott", "tmpl": "Dear ${name},\n  EOT"}
+	check := func(cfg *CfgBlock) {
+		for col, val := range want {
+			if got := cfg.Str("db", "report", col, "BLANK"); got != val {
+				t.Errorf("Expected %s = %q, got %q", col, val, got)
+			}
+		}
+		if cfg.Int("db", "after", "x", 0) != 1 {
+			t.Error("Expected the row following the heredoc to be read")
+		}
+	}
+	check(cfg)
+
+	tempfile := filepath.Join(t.TempDir(), "heredoc.cfg")
+	cfg.CfgWrite(tempfile)
+	if cfg, err = ld.Load(tempfile); err != nil {
+		t.Fatal("Load of written file failed, err =", err)
+	}
+	check(cfg)
+
+	_, err = LoadString("bad.cfg", "%block db\n{\n  row1 :: a=<<EOT\nselect 1\n}\n")
+	var errs ErrorList
+	if !errors.Is(err, ErrUnterminatedHeredoc) || !errors.As(err, &errs) || errs[0].Line != 3 {
+		t.Errorf("Expected ErrUnterminatedHeredoc at line 3, got %v", err)
+	}
+}
+
+// writeCfgFile writes content to dir/name and returns its path
+func writeCfgFile(t *testing.T, dir, name, content string) string {
+	fname := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal("Error writing test config", fname, "err =", err)
+	}
+	return fname
+}
+
+// To test that CfgWrite() writes top-level rows, and blocks nested within blocks created by EditEntry()
+func TestCfgWriteNested(t *testing.T) {
+	cfg, err := LoadString("nested.cfg", "top :: a=1;\n%block b1\n{\n  %block b2\n  {\n    %block b3\n    {\n      deep :: x=1;\n    }\n  }\n}\n")
+	if err != nil {
+		t.Fatal("LoadString failed, err =", err)
+	}
+	cfg.EditEntry("b4", "row4", "y", "2")
+	tempfile := filepath.Join(t.TempDir(), "nested.cfg")
+	cfg.CfgWrite(tempfile)
+	cfg2, err := Load(tempfile)
+	if err != nil {
+		t.Fatal("Load of written file failed, err =", err)
+	}
+	if !isTreeEqual(cfg, cfg2) || cfg2.SelfInt("top", "a", 0) != 1 || cfg2.NestedInt([]string{"b1", "b2", "b3"}, "deep", "x", 0) != 1 {
+		t.Error("Expected the written config to read back the same")
+	}
+}
+
+// To test that blocks, rows and columns are listed and written in declaration order, or sorted by Sort()
+func TestDeclarationOrder(t *testing.T) {
+	text := "%block zeta\n{\n  r2 :: c=1; a=2; b=3;\n  r1 :: z=1;\n    += y=2;\n}\n%block alpha\n{\n}\n%block mid\n{\n}\n%block zeta\n{\n  r2 :: c=1; a=2; b=3;\n  r1 :: z=1;\n    += y=2;\n}\n"
+	cfg, err := LoadString("order.cfg", text)
+	if err != nil {
+		t.Fatal("LoadString failed, err =", err)
+	}
+	check := func(what string, want, got []string) {
+		if strings.Join(want, ",") != strings.Join(got, ",") {
+			t.Errorf("Expected %s = %v, got %v", what, want, got)
+		}
+	}
+	check("blocks", []string{"zeta", "alpha", "mid"}, cfg.GetBlocks())
+	check("rows", []string{"r2", "r1"}, cfg.GetRows("zeta"))
+	check("cols", []string{"c", "a", "b"}, cfg.GetCols("zeta", "r2"))
+	check("cols", []string{"z", "y"}, cfg.GetCols("zeta", "r1"))
+
+	dir := t.TempDir()
+	cfg.CfgWrite(filepath.Join(dir, "1.cfg"))
+	cfg.CfgWrite(filepath.Join(dir, "2.cfg"))
+	out1, _ := ioutil.ReadFile(filepath.Join(dir, "1.cfg"))
+	out2, _ := ioutil.ReadFile(filepath.Join(dir, "2.cfg"))
+	if string(out1) != string(out2) || strings.Index(string(out1), "zeta") > strings.Index(string(out1), "alpha") {
+		t.Errorf("Expected CfgWrite output to be stable and in declaration order, got\n%s", out1)
+	}
+
+	cfg.Sort()
+	check("sorted blocks", []string{"alpha", "mid", "zeta"}, cfg.GetBlocks())
+	check("sorted rows", []string{"r1", "r2"}, cfg.GetRows("zeta"))
+	check("sorted cols", []string{"a", "b", "c"}, cfg.GetCols("zeta", "r2"))
+}
+
+// To test that CfgWrite() keeps the mode of the file it replaces, keeps a backup, and returns errors
+func TestCfgWriteAtomic(t *testing.T) {
+	cfg, err := LoadString("mem.cfg", "%block a\n{\n  r :: c=1;\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	fname := writeCfgFile(t, dir, "a.cfg", "old content\n")
+	if err := os.Chmod(fname, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.CfgWrite(fname, WriteOptions{Backup: true}); err != nil {
+		t.Fatal("CfgWrite failed, err =", err)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected the mode 0600 of the replaced file to be kept, got %v, %v", fi.Mode(), err)
+	}
+	if old, err := ioutil.ReadFile(fname + ".bak"); err != nil || string(old) != "old content\n" {
+		t.Errorf("Expected the backup to hold the old content, got %q, %v", old, err)
+	}
+	if cfg2, err := Load(fname); err != nil || cfg2.Str("a", "r", "c", "") != "1" {
+		t.Errorf("Expected the written config to read back, got %v", err)
+	}
+
+	if err := cfg.CfgWrite(filepath.Join(dir, "new.cfg")); err != nil {
+		t.Fatal("CfgWrite failed, err =", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "new.cfg")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("Expected a new file to have mode 0644, got %v, %v", fi.Mode(), err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".*tmp*")); len(files) > 0 {
+		t.Errorf("Expected no temporary files to be left, got %v", files)
+	}
+	if err := cfg.CfgWrite(filepath.Join(dir, "missing", "x.cfg")); err == nil {
+		t.Error("Expected an error writing into a missing directory")
+	}
+}
+
+// To test the policies for blocks and rows declared more than once, and their warnings
+func TestDuplicates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.cfg": {Data: []byte("%block app\n{\n  server :: host=a; port=1;\n}\n%include more.cfg\n")},
+		"more.cfg": {Data: []byte("%block app\n{\n  server :: host=b;\n  server :: user=c;\n}\n")},
+	}
+	var warnings []error
+	ld := Loader{FS: fsys, Warn: func(err error) { warnings = append(warnings, err) }}
+	cfg, err := ld.Load("main.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("app", "server", "user", "") != "c" || cfg.Str("app", "server", "port", "") != "" {
+		t.Error("Expected the last declaration to replace the earlier ones by default")
+	}
+	want := []string{
+		"duplicate block app declared at main.cfg:1, more.cfg:1",
+		"duplicate row app.server declared at more.cfg:3, more.cfg:4",
+	}
+	if len(warnings) != len(want) {
+		t.Fatalf("Expected %d warnings, got %v", len(want), warnings)
+	}
+	for ii, err := range warnings {
+		if err.Error() != want[ii] {
+			t.Errorf("Expected warning %q, got %q", want[ii], err)
+		}
+	}
+
+	ld = Loader{FS: fsys, Duplicates: DupMerge}
+	if cfg, err = ld.Load("main.cfg"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("app", "server", "host", "") != "b" || cfg.Str("app", "server", "port", "") != "1" || cfg.Str("app", "server", "user", "") != "c" {
+		t.Error("Expected the declarations to be merged under DupMerge")
+	}
+
+	ld = Loader{FS: fsys, Duplicates: DupError}
+	_, err = ld.Load("main.cfg")
+	var derr *DuplicateError
+	var el ErrorList
+	if !errors.As(err, &el) || len(el) != 2 || !errors.As(el[0], &derr) || derr.Kind != KindBlock || derr.Path != "app" {
+		t.Errorf("Expected errors for the duplicate block and row under DupError, got %v", err)
+	}
+
+	// %duplicates holds for the rest of its file and the files it includes
+	fsys["main.cfg"] = &fstest.MapFile{Data: []byte("%duplicates merge\n%block app\n{\n  server :: host=a; port=1;\n}\n%include more.cfg\n")}
+	fsys["more.cfg"] = &fstest.MapFile{Data: []byte("%block app\n{\n  server :: host=b;\n}\n%duplicates replace\n%block app\n{\n  other :: x=1;\n}\n")}
+	fsys["bad.cfg"] = &fstest.MapFile{Data: []byte("%duplicates sometimes\n")}
+	if cfg, err = LoadFS(fsys, "main.cfg"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RowExists("app", "server") || !cfg.RowExists("app", "other") {
+		t.Error("Expected a later replace policy to take over from merge")
+	}
+	if _, err = LoadFS(fsys, "bad.cfg"); !errors.Is(err, ErrBadDirective) {
+		t.Errorf("Expected ErrBadDirective, got %v", err)
+	}
+}
+
+// To test %block xxx %extends yyy
+func TestExtends(t *testing.T) {
+	cfg, err := LoadString("ext.cfg", `
+%block base
+{
+  server :: host=alpha; port=80; url=http://${base.server.host}:${base.server.port};
+  log    :: level=info;
+%block db
+{
+  main :: name=prod;
+}
+}
+%block dev %extends base
+{
+  server :: host=beta;
+%block db
+{
+  main :: user=dev;
+}
+}
+%block test %extends dev
+{
+  log :: level=debug;
+}
+%block apps
+{
+%block web %extends test
+{
+}
+%block api %extends web
+{
+}
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("dev", "server", "host", "") != "beta" || cfg.Str("dev", "server", "port", "") != "80" || cfg.Str("dev", "log", "level", "") != "info" {
+		t.Error("Expected dev to inherit the rows and columns of base it does not define")
+	}
+	if cfg.Str("dev", "server", "url", "") != "http://alpha:80" {
+		t.Errorf("Expected the references of base to be resolved as in base, got %q", cfg.Str("dev", "server", "url", ""))
+	}
+	if cfg.NestedStr([]string{"dev", "db"}, "main", "name", "") != "prod" || cfg.NestedStr([]string{"dev", "db"}, "main", "user", "") != "dev" {
+		t.Error("Expected dev to inherit the nested blocks of base")
+	}
+	if cfg.Str("test", "server", "host", "") != "beta" || cfg.Str("test", "log", "level", "") != "debug" {
+		t.Error("Expected test to inherit through dev")
+	}
+	if cfg.NestedStr([]string{"apps", "api"}, "log", "level", "") != "debug" || cfg.NestedStr([]string{"apps", "api"}, "server", "port", "") != "80" {
+		t.Error("Expected a parent to be found by path and among sibling blocks")
+	}
+	if rows := cfg.GetRows("dev"); len(rows) != 2 || rows[0] != "server" || rows[1] != "log" {
+		t.Errorf("Expected the rows of base first, got %v", rows)
+	}
+
+	for _, text := range []string{
+		"%block base\n{\n%block sub\n{\n  r :: a=1;\n}\n}\n%block dev %extends base\n{\n}\n%block x %extends dev.sub\n{\n}\n%block y %extends x\n{\n}\n",
+		"%block y %extends x\n{\n}\n%block x %extends dev.sub\n{\n}\n%block dev %extends base\n{\n}\n%block base\n{\n%block sub\n{\n  r :: a=1;\n}\n}\n",
+	} {
+		cfg, err = LoadString("inherited.cfg", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Str("x", "r", "a", "") != "1" || cfg.Str("y", "r", "a", "") != "1" {
+			t.Errorf("Expected a block inherited by dev to be extended, in either order, got %q", cfg.Str("y", "r", "a", ""))
+		}
+	}
+
+	if _, err = LoadString("bad.cfg", "%block a %extends nowhere\n{\n}\n"); !errors.Is(err, ErrUnknownBlock) {
+		t.Errorf("Expected ErrUnknownBlock, got %v", err)
+	}
+	if _, err = LoadString("bad.cfg", "%block a %extends b\n{\n}\n%block b %extends a\n{\n}\n"); !errors.Is(err, ErrExtendsCycle) {
+		t.Errorf("Expected ErrExtendsCycle, got %v", err)
+	}
+}
+
+// To test rows taking their columns from a template row with %from
+func TestRowTemplate(t *testing.T) {
+	cfg, err := LoadString("jobs.cfg", `
+%block jobs
+{
+  job  :: days=MTWTF; start=08:00; end=17:00; log=/var/log/${jobs.job.days}.log;
+  job2 :: %from=job; region=EMEA; start=09:00;
+  job3 :: region=NAM;
+       += %from=job2;
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("jobs", "job2", "days", "") != "MTWTF" || cfg.Str("jobs", "job2", "start", "") != "09:00" || cfg.Str("jobs", "job2", "region", "") != "EMEA" {
+		t.Error("Expected job2 to take the columns it does not set from job")
+	}
+	if cfg.Str("jobs", "job2", "%from", "none") != "none" {
+		t.Error("Expected the template name not to be kept as a column")
+	}
+	if cols := cfg.GetCols("jobs", "job2"); len(cols) != 5 || cols[0] != "days" || cols[4] != "region" {
+		t.Errorf("Expected the columns of the template first, got %v", cols)
+	}
+	if cfg.Str("jobs", "job3", "region", "") != "NAM" || cfg.Str("jobs", "job3", "start", "") != "09:00" || cfg.Str("jobs", "job3", "log", "") != "/var/log/MTWTF.log" {
+		t.Error("Expected job3 to take the columns of job2 named on a += line, references resolved")
+	}
+
+	if _, err = LoadString("bad.cfg", "%block a\n{\n  r :: %from=later; x=1;\n  later :: y=1;\n}\n"); !errors.Is(err, ErrUnknownRow) {
+		t.Errorf("Expected ErrUnknownRow for a template declared after its use, got %v", err)
+	}
+}
+
+// To test %include parameters and %define
+func TestIncludeParams(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.cfg": {Data: []byte(`%define owner=ops
+%block NAM
+{
+%include region.cfg region=NAM tz=US/Eastern
+}
+%block EMEA
+{
+%include "region.cfg" region=EMEA tz="Europe/London"
+}
+%define owner=${owner}-team
+%block all
+{
+  r :: owner=${owner}; site=${site}; region=${region:-none};
+}
+`)},
+		"region.cfg": {Data: []byte("%define host=${region}-01\nfeed :: tz=${tz}; host=${host}; owner=${owner}; path=${HOME};\n")},
+	}
+	ld := Loader{FS: fsys, Vars: map[string]string{"site": "ny"}, LookupEnv: func(_name string) (string, bool) {
+		return "/home/" + _name, _name == "HOME"
+	}}
+	cfg, err := ld.Load("main.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("NAM", "feed", "tz", "") != "US/Eastern" || cfg.Str("NAM", "feed", "host", "") != "NAM-01" || cfg.Str("NAM", "feed", "owner", "") != "ops" {
+		t.Error("Expected the parameters and definitions to be substituted in the included file")
+	}
+	if cfg.Str("EMEA", "feed", "tz", "") != "Europe/London" || cfg.Str("EMEA", "feed", "host", "") != "EMEA-01" || cfg.Str("EMEA", "feed", "path", "") != "/home/HOME" {
+		t.Error("Expected each include to get its own parameters, the environment after them")
+	}
+	if cfg.Str("all", "r", "owner", "") != "ops-team" || cfg.Str("all", "r", "site", "") != "ny" || cfg.Str("all", "r", "region", "") != "none" {
+		t.Error("Expected include parameters not to outlive the include, Loader.Vars to be used")
+	}
+
+	ld = Loader{FS: fsys, NoEnv: true}
+	if cfg, err = ld.Load("main.cfg"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("NAM", "feed", "tz", "") != "US/Eastern" || cfg.Str("NAM", "feed", "path", "") != "${HOME}" {
+		t.Error("Expected the definitions to be substituted but not the environment under NoEnv")
+	}
+
+	// parameters in the names of blocks and rows
+	fsys["feeds.cfg"] = &fstest.MapFile{Data: []byte("%include feed.cfg region=NAM\n%include feed.cfg region=EMEA\n%define gone=EMEA\n%delete feed_${gone}.${gone}_job\n")}
+	fsys["feed.cfg"] = &fstest.MapFile{Data: []byte("%block feed_${region}\n{\n  ${region}_job :: name=${region};\n  other :: %from=${region}_job;\n}\n")}
+	var warnings []error
+	ld = Loader{FS: fsys, NoEnv: true, Warn: func(err error) { warnings = append(warnings, err) }}
+	if cfg, err = ld.Load("feeds.cfg"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("feed_NAM", "NAM_job", "name", "") != "NAM" || cfg.Str("feed_EMEA", "other", "name", "") != "EMEA" || len(warnings) > 0 {
+		t.Errorf("Expected a block per include, named after its parameters, got %v %v", cfg.GetBlocks(), warnings)
+	}
+	if cfg.RowExists("feed_EMEA", "EMEA_job") || !cfg.RowExists("feed_NAM", "NAM_job") {
+		t.Error("Expected the path to delete to be substituted")
+	}
+	if _, err = ld.LoadString("bad.cfg", "%block feed_${region}\n{\n}\n"); !errors.Is(err, ErrBadDirective) {
+		t.Errorf("Expected ErrBadDirective for a name left holding ${, got %v", err)
+	}
+
+	if _, err = LoadString("bad.cfg", "%define a.b=1\n"); !errors.Is(err, ErrBadDirective) {
+		t.Errorf("Expected ErrBadDirective, got %v", err)
+	}
+}
+
+// To test %if, %else and %endif
+func TestConditions(t *testing.T) {
+	src := `
+%block app
+{
+%if env == "prod"
+  db :: host=prod-db;
+%if region != NAM
+  db += replica=yes;
+%endif
+%else
+  db :: host=localhost;
+%if env == prod # comments are allowed
+  db += replica=no;
+%endif
+%endif
+%if !debug
+  log :: level=info;
+%endif
+%if hostname
+  me :: x=1;
+%endif
+}
+`
+	ld := Loader{NoEnv: true, Vars: map[string]string{"env": "prod", "region": "EMEA"}}
+	cfg, err := ld.LoadString("cond.cfg", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("app", "db", "host", "") != "prod-db" || cfg.Str("app", "db", "replica", "") != "yes" || cfg.Str("app", "log", "level", "") != "info" {
+		t.Error("Expected the sections whose condition holds to be read")
+	}
+	if !cfg.RowExists("app", "me") {
+		t.Error("Expected hostname to be set")
+	}
+	if cfg, err = ld.LoadString("cond.cfg", "%if env != \"prod#1\" # a comment\nr :: x=1;\n%endif\n"); err != nil || cfg.SelfStr("r", "x", "") != "1" {
+		t.Errorf("Expected a quoted # not to start a comment, got %v", err)
+	}
+	if cfg, err = ld.LoadString("cond.cfg", "%if env != \"a==b\"\nr :: x=1;\n%endif\n%if env == \"a!=b\"\nr :: y=1;\n%endif\n"); err != nil || cfg.SelfStr("r", "x", "") != "1" || cfg.SelfStr("r", "y", "none") != "none" {
+		t.Errorf("Expected an operator within a quoted value to be part of it, got %v", err)
+	}
+	skipped := "%if env == dev\nr :: text=<<EOT\n%endif\nEOT\n   += more=<<'EOT'\n%else\nEOT\n%endif\nr2 :: x=1;\n"
+	if cfg, err = ld.LoadString("cond.cfg", skipped); err != nil || cfg.SelfStr("r", "text", "none") != "none" || cfg.SelfStr("r2", "x", "") != "1" {
+		t.Errorf("Expected the heredoc of a row not read to be skipped, got %v", err)
+	}
+	ld.Vars = map[string]string{"env": "dev", "debug": "1"}
+	if cfg, err = ld.LoadString("cond.cfg", src); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("app", "db", "host", "") != "localhost" || cfg.Str("app", "db", "replica", "") != "" || cfg.RowExists("app", "log") {
+		t.Error("Expected the other branches to be read when the condition does not hold")
+	}
+
+	for _, tt := range []struct {
+		src  string
+		want error
+	}{
+		{"%if a\nr :: c=1;\n", ErrUnterminatedCond},
+		{"%endif\n", ErrUnmatchedCond},
+		{"%if a\n%else\n%else\n%endif\n", ErrUnmatchedCond},
+		{"%if a == b c\n%endif\n", ErrBadDirective},
+		{"%if a == \"b#c\n%endif\n", ErrBadDirective},
+		{"%if !a == b\n%endif\n", ErrBadDirective},
+	} {
+		if _, err = LoadString("bad.cfg", tt.src); !errors.Is(err, tt.want) {
+			t.Errorf("Expected %v for %q, got %v", tt.want, tt.src, err)
+		}
+	}
+}
+
+// To test %unset and %delete
+func TestUnsetDelete(t *testing.T) {
+	fsys := fstest.MapFS{
+		"base.cfg": {Data: []byte("%block app\n{\n  server :: host=a; port=1; debug=yes;\n  cache :: size=10;\n  log :: level=info;\n%block extra\n{\n  r :: x=1;\n}\n}\ntop :: a=1; b=2;\n")},
+		"site.cfg": {Data: []byte("%include base.cfg\n%unset app.server.debug top.b\n%delete app.cache app.extra\n%block app\n{\n  cache :: size=20;\n}\n")},
+	}
+	var warnings []error
+	ld := Loader{FS: fsys, Duplicates: DupMerge, Warn: func(err error) { warnings = append(warnings, err) }}
+	cfg, err := ld.Load("site.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cols := cfg.GetCols("app", "server"); len(cols) != 2 || cols[0] != "host" || cols[1] != "port" {
+		t.Errorf("Expected debug to be unset, got %v", cols)
+	}
+	if cfg.SelfStr("top", "b", "none") != "none" || cfg.SelfStr("top", "a", "") != "1" {
+		t.Error("Expected a top-level column to be unset")
+	}
+	if rows := cfg.GetRows("app"); len(rows) != 3 || rows[2] != "cache" || cfg.Str("app", "cache", "size", "") != "20" {
+		t.Errorf("Expected cache to be deleted then declared again, got %v", rows)
+	}
+	if len(cfg.GetBlock([]string{"app"}).GetBlocks()) != 0 {
+		t.Error("Expected the block extra to be deleted")
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Expected only the block app to be reported as declared again, got %v", warnings)
+	}
+
+	fsys["bad.cfg"] = &fstest.MapFile{Data: []byte("%include base.cfg\n%unset app.server.nope\n%delete app.nope\n")}
+	var el ErrorList
+	if _, err = LoadFS(fsys, "bad.cfg"); !errors.As(err, &el) || len(el) != 2 || !errors.Is(el[1], ErrMissingElement) {
+		t.Errorf("Expected ErrMissingElement twice, got %v", err)
+	}
+
+	// edits of what was removed cannot be written back, the directive would remove them again
+	dir := t.TempDir()
+	base := writeCfgFile(t, dir, "base.cfg", "%block app\n{\n  server :: host=a; debug=yes;\n  old :: x=1;\n}\n%block extra\n{\n  r :: x=1;\n}\n")
+	site := writeCfgFile(t, dir, "site.cfg", "%include base.cfg\n%unset app.server.debug\n%delete app.old extra\n")
+	for _, edit := range [][]string{{"app", "server", "debug"}, {"app", "old", "x"}, {"extra", "r", "x"}, {"app", "server", "host"}} {
+		if cfg, err = Load(site); err != nil {
+			t.Fatal(err)
+		}
+		cfg.EditEntry(edit[0], edit[1], edit[2], "no")
+		err = cfg.SaveAll()
+		if edit[2] == "host" && err != nil {
+			t.Errorf("Expected an edit of a kept column to be saved, got %v", err)
+		} else if edit[2] != "host" && !errors.Is(err, ErrRemoved) {
+			t.Errorf("Expected ErrRemoved for an edit of %v, got %v", edit, err)
+		}
+	}
+	if data, _ := os.ReadFile(base); strings.Count(string(data), "=no") != 1 || !strings.Contains(string(data), "host=no;") {
+		t.Errorf("Expected only the edit of host to be written, got\n%s", data)
+	}
+}
+
+// To test Loader.Raw and writing back with WriteOptions.Raw
+func TestRaw(t *testing.T) {
+	ld := Loader{Raw: true, LookupEnv: func(string) (string, bool) { return "env", true }}
+	cfg, err := ld.LoadString("raw.cfg", "%block db\n{\n  main :: host=${DB_HOST}; url=\"${db.main.host}; x\"; q=<<EOT\n${A}\nEOT;\n}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Str("db", "main", "host", "") != "${DB_HOST}" || cfg.Str("db", "main", "url", "") != "${db.main.host}; x" {
+		t.Error("Expected ${...} to be kept as written")
+	}
+	fname := filepath.Join(t.TempDir(), "out.cfg")
+	if err := cfg.CfgWrite(fname, WriteOptions{Raw: true}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(fname)
+	if !strings.Contains(string(data), "host=${DB_HOST};") || strings.Contains(string(data), "'") {
+		t.Errorf("Expected ${...} to be written to be substituted, got\n%s", data)
+	}
+	if cfg2, err := ld.Load(fname); err != nil || !isTreeEqual(cfg, cfg2) {
+		t.Errorf("Expected the written config to read back the same, got %v", err)
+	}
+
+	for _, src := range []string{
+		"%include other.cfg\n",
+		"%define a=1\n",
+		"%block a %extends b\n{\n}\n",
+		"r :: a=1;\ns :: %from=r;\n",
+		"r :: a='${X}';\n",
+	} {
+		if _, err = ld.LoadString("raw.cfg", src); !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("Expected ErrNotAllowed for %q, got %v", src, err)
+		}
+	}
+}
+
+// To test that a value declared again drops the cross-references of the earlier one
+func TestRefRedeclared(t *testing.T) {
+	for _, src := range []string{
+		"%block b\n{\n  r :: c=${a.r.x};\n  r :: c='${job.name}';\n}\n",
+		"%duplicates merge\n%block b\n{\n  r :: c=${a.r.x}; d=1;\n}\n%block b\n{\n  r :: c=<<'EOT'\n${job.name}\nEOT;\n}\n",
+		"%block a\n{\n  r :: x=1;\n}\n%block b\n{\n  r :: c=${a.r.x};\n       += c='${job.name}';\n}\n",
+		"%block b\n{\n  r :: c=${a.r.x};\n}\n%unset b.r.c\n%block b\n{\n  r :: c='${job.name}';\n}\n",
+	} {
+		cfg, err := LoadString("x.cfg", src)
+		if err != nil {
+			t.Errorf("Expected no error for %q, got %v", src, err)
+			continue
+		}
+		if val := cfg.Str("b", "r", "c", ""); val != "${job.name}" {
+			t.Errorf("Expected the literal to be kept for %q, got %q", src, val)
+		}
+	}
+	if _, err := LoadString("x.cfg", "%block b\n{\n  r :: c=${a.r.x};\n}\n%block b\n{\n}\n"); err != nil {
+		t.Errorf("Expected no error for a reference within a replaced block, got %v", err)
+	}
+}
+
+// isTreeEqual checks that two configs hold the same blocks, rows and columns
+func isTreeEqual(a, b *CfgBlock) bool {
+	if len(a.rows) != len(b.rows) || len(a.tbls) != len(b.tbls) {
+		return false
+	}
+	for name, rowa := range a.rows {
+		rowb, ok := b.rows[name]
+		if !ok || len(rowa.cols) != len(rowb.cols) {
+			return false
+		}
+		for col, val := range rowa.cols {
+			if vb, ok := rowb.cols[col]; !ok || vb != val {
+				return false
+			}
+		}
+	}
+	for name, tbla := range a.tbls {
+		tblb, ok := b.tbls[name]
+		if !ok || !isTreeEqual(tbla, tblb) {
+			return false
+		}
+	}
+	return true
+}
+
 // isSetEqual Function sorts the strings & checks both are equal are not.
 func isSetEqual(a, b []string) bool {
 	if len(a) != len(b) {